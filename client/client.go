@@ -1,9 +1,13 @@
 package client
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/dcos/octarine/util"
@@ -15,16 +19,80 @@ type Client struct {
 	ListenSock string
 	WriteSock  string
 	QueryPort  bool
+	TLSPort    bool
+	Entries    bool
+	Stats      bool
+	Flush      bool
+	Invalidate []string
+	Prewarm    []string
+	Watch      []string
 }
 
 // Run starts the client
 func (ct *Client) Run() {
-	if ct.QueryPort {
+	switch {
+	case ct.QueryPort:
 		ct.queryPort()
+	case ct.TLSPort:
+		ct.query(util.QueryTLSPort)
+	case ct.Entries:
+		ct.query(util.QueryEntries)
+	case ct.Stats:
+		ct.query(util.QueryStats)
+	case ct.Flush:
+		ct.query(util.QueryFlush)
+	case len(ct.Invalidate) > 0:
+		ct.query(util.QueryInvalidate, ct.Invalidate...)
+	case len(ct.Prewarm) > 0:
+		ct.query(util.QueryPrewarm, ct.Prewarm...)
+	case len(ct.Watch) > 0:
+		ct.watch(ct.Watch...)
 	}
 }
 
 func (ct *Client) queryPort() {
+	ct.query(util.QueryPort)
+}
+
+// query sends cmd to the server and prints the response.
+func (ct *Client) query(cmd string, args ...string) {
+	fd := ct.send(cmd, args...)
+	defer fd.Close()
+	buf, err := ioutil.ReadAll(fd)
+	if err != nil {
+		log.Fatal("read error: ", err)
+	}
+	resp := strings.TrimSuffix(string(buf), "\n")
+	if strings.HasPrefix(resp, "error: ") {
+		log.Fatal(resp)
+	}
+	fmt.Println(resp)
+}
+
+// watch follows the changes to the record sets of names and prints them as
+// they come, until the server goes away.
+func (ct *Client) watch(names ...string) {
+	fd := ct.send(util.QueryWatch, names...)
+	defer fd.Close()
+	r := bufio.NewReader(fd)
+	for {
+		line, err := r.ReadString('\n')
+		if strings.HasPrefix(line, "error: ") {
+			log.Fatal(strings.TrimSuffix(line, "\n"))
+		}
+		fmt.Print(line)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatal("read error: ", err)
+		}
+	}
+}
+
+// send sends cmd to the server and returns the connection the response is
+// written to.
+func (ct *Client) send(cmd string, args ...string) net.Conn {
 	if err := util.RmIfExist(ct.ListenSock); err != nil {
 		log.Fatal(err)
 	}
@@ -44,7 +112,8 @@ func (ct *Client) queryPort() {
 	}
 	defer netw.Close()
 
-	_, err = netw.Write([]byte(" "))
+	line := strings.Join(append([]string{cmd}, args...), " ") + "\n"
+	_, err = netw.Write([]byte(line))
 	if err != nil {
 		log.Fatal("write error: ", err)
 	}
@@ -53,9 +122,5 @@ func (ct *Client) queryPort() {
 	if err != nil {
 		log.Fatal("accept error: ", err)
 	}
-	buf := make([]byte, util.MaxPortLength)
-	if _, err = fd.Read(buf); err != nil {
-		log.Fatal("read error: ", err)
-	}
-	fmt.Println(string(buf))
+	return fd
 }
@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/dcos/octarine/client"
 	"github.com/dcos/octarine/server"
+	"github.com/dcos/octarine/srv"
 	"github.com/dcos/octarine/util"
 )
 
@@ -18,17 +22,92 @@ import (
 //   remove all the pointer deferences.
 
 var cacheTimeout = flag.Int("cache-timeout", 5,
-	"SRV record cache timeout in seconds.")
+	"SRV record cache timeout in seconds, used when the TTL is unknown.")
+var cacheMinTTL = flag.Int("cache-min-ttl", 0,
+	"Minimum time in seconds to cache an SRV record set.")
+var cacheMaxTTL = flag.Int("cache-max-ttl", 0,
+	"Maximum time in seconds to cache an SRV record set, 0 for no limit.")
+var negativeTTL = flag.Int("negative-cache-timeout", 2,
+	"Time in seconds to cache failed SRV lookups, 0 to disable.")
+var maxStale = flag.Int("cache-max-stale", 60,
+	"Time in seconds an expired SRV record set is still served while it's "+
+		"refreshed or DNS is failing, 0 to disable.")
+var maxEntries = flag.Int("cache-max-entries", 10000,
+	"Maximum number of names in the SRV cache, 0 for no limit.")
+var cacheSnapshot = flag.Bool("cache-snapshot", false,
+	"Save the SRV cache to the octarine temp dir and load it on start.")
+var cacheSnapshotInterval = flag.Int("cache-snapshot-interval", 60,
+	"Interval in seconds to save the SRV cache snapshot, 0 to only save on "+
+		"shutdown.")
+var resolveHosts = flag.Bool("resolve-targets", true,
+	"Resolve SRV targets to IP addresses and cache them.")
+var resolver = flag.String("resolver", "",
+	fmt.Sprintf("Comma separated chain of SRV resolvers [%s] tried in "+
+		"order, each optionally with a timeout, e.g., static,mesos-dns=2s. "+
+		"Defaults to %s if -dns-servers is set and %s otherwise.",
+		strings.Join(server.Resolvers, "/"), server.DNSResolver,
+		server.SystemResolver))
+var dnsServers = flag.String("dns-servers", "",
+	"Comma separated DNS servers (ip[:port]) to query for SRV records, "+
+		"tried in order.")
+var dnsTimeout = flag.Int("dns-timeout", 2,
+	"Timeout in seconds for each query to a DNS server, Mesos-DNS or "+
+		"Marathon.")
+var mesosDNSURL = flag.String("mesos-dns-url", "",
+	"Base URL of the Mesos-DNS HTTP API, e.g., http://leader.mesos:8123.")
+var marathonURL = flag.String("marathon-url", "",
+	"Base URL of the Marathon API, e.g., http://marathon.mesos:8080.")
+var staticFile = flag.String("static-file", "",
+	"JSON file mapping service names to host:port targets, reloaded when "+
+		"it changes.")
+var marathonInterval = flag.Int("marathon-interval", 30,
+	"Interval in seconds to poll the Marathon apps.")
+var marathonEvents = flag.Bool("marathon-events", true,
+	"Follow the Marathon event stream to pick up task changes immediately.")
 var verbose = flag.Bool("verbose", false, "Verbose output.")
 var cmode = flag.Bool("client", false, "Client mode.")
 var proxyMode = flag.String("mode", "",
-	fmt.Sprintf("Proxy mode [%s/%s]", server.StandardMode, server.TransparentMode))
+	fmt.Sprintf("Proxy mode [%s]", strings.Join(server.ProxyModes, "/")))
 var printVersion = flag.Bool("version", false, "Print the version")
 var bindPort = flag.Int("bindPort", 0, "Port to bind on")
+var bindAddr = flag.String("bindAddr", "127.0.0.1",
+	"Address to bind on, e.g., 0.0.0.0 to accept connections redirected "+
+		"from other network namespaces in intercept mode.")
+var tlsBindPort = flag.Int("tlsBindPort", 0,
+	"Port to bind the TLS listener on, only in transparent mode.")
+var defaultDomain = flag.String("default-domain", srv.MarathonDomain,
+	"Domain of short SRV names like _app, _app._udp or _http._app, empty to "+
+		"only accept full names.")
+var defaultProto = flag.String("default-proto", srv.DefaultProto,
+	"Protocol of short SRV names like _app or _http._app.")
+var forwards = flag.String("forward", "",
+	"Comma separated TCP port forwards to SRV names as [addr:]port=name, "+
+		"e.g., 5432=_postgres._tcp.marathon.mesos.")
+var configFile = flag.String("config", "",
+	"JSON configuration file with per service TTL and routing overrides.")
 
 // Below requires client mode
 var queryPort = flag.Bool("port", false,
 	"Query the port that's being listened on, only available in client mode.")
+var queryTLSPort = flag.Bool("tls-port", false,
+	"Query the port of the TLS listener, only available in client mode.")
+var queryEntries = flag.Bool("entries", false,
+	"Print the SRV cache entries, only available in client mode.")
+var queryStats = flag.Bool("stats", false,
+	"Print the SRV cache counters, only available in client mode.")
+var queryFlush = flag.Bool("flush", false,
+	"Drop all SRV cache entries, only available in client mode.")
+var queryInvalidate = flag.String("invalidate", "",
+	"Comma separated names to drop from the SRV cache, only available in "+
+		"client mode.")
+var queryWatch = flag.String("watch", "",
+	"Comma separated names to follow the SRV record changes of, only "+
+		"available in client mode.")
+
+// Available in both modes
+var prewarm = flag.String("prewarm", "",
+	"Comma separated names to resolve, on start in server mode or right "+
+		"away in client mode.")
 
 func main() {
 	flag.Parse()
@@ -44,6 +123,7 @@ func main() {
 	if id == "" {
 		log.Fatal("Please supply an identifier for this proxy instance")
 	}
+	var forwardList []server.Forward
 	if !*cmode {
 		if *proxyMode == "" {
 			log.Fatal("Please supply a proxy mode")
@@ -51,6 +131,49 @@ func main() {
 		if !server.ValidProxyMode(*proxyMode) {
 			log.Fatalf("%s is an invalid proxy mode", *proxyMode)
 		}
+		if *defaultProto != "tcp" && *defaultProto != "udp" {
+			log.Fatalf("%s is an invalid default protocol", *defaultProto)
+		}
+		if *resolver == "" {
+			*resolver = server.SystemResolver
+			if *dnsServers != "" {
+				*resolver = server.DNSResolver
+			}
+		}
+		if *cacheTimeout < 0 {
+			log.Fatal("The cache timeout can't be negative")
+		}
+		if *dnsTimeout <= 0 {
+			log.Fatal("The DNS timeout must be positive")
+		}
+		if *marathonInterval <= 0 {
+			log.Fatal("The Marathon interval must be positive")
+		}
+		for _, spec := range splitList(*forwards) {
+			f, err := server.ParseForward(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			forwardList = append(forwardList, f)
+		}
+		for _, spec := range splitList(*resolver) {
+			name, _, err := server.ParseResolver(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if name == server.DNSResolver && *dnsServers == "" {
+				log.Fatal("Please supply DNS servers")
+			}
+			if name == server.MesosDNSResolver && *mesosDNSURL == "" {
+				log.Fatal("Please supply a Mesos-DNS URL")
+			}
+			if name == server.MarathonResolver && *marathonURL == "" {
+				log.Fatal("Please supply a Marathon URL")
+			}
+			if name == server.StaticResolver && *staticFile == "" {
+				log.Fatal("Please supply a static registry file")
+			}
+		}
 	}
 
 	sockdir := path.Join(os.TempDir(), "octarine")
@@ -64,6 +187,13 @@ func main() {
 		c := &client.Client{
 			ID:         id,
 			QueryPort:  *queryPort,
+			TLSPort:    *queryTLSPort,
+			Entries:    *queryEntries,
+			Stats:      *queryStats,
+			Flush:      *queryFlush,
+			Invalidate: splitList(*queryInvalidate),
+			Prewarm:    splitList(*prewarm),
+			Watch:      splitList(*queryWatch),
 			ListenSock: portsock,
 			WriteSock:  querysock,
 		}
@@ -71,13 +201,68 @@ func main() {
 		os.Exit(0)
 	}
 
+	var snapshot string
+	if *cacheSnapshot {
+		snapshot = path.Join(sockdir, fmt.Sprintf("%s.cache.json", id))
+	}
 	s := &server.Server{
 		ID:           id,
 		Verbose:      *verbose,
 		CacheTimeout: *cacheTimeout,
+		CacheMinTTL:  *cacheMinTTL,
+		CacheMaxTTL:  *cacheMaxTTL,
+		NegativeTTL:  *negativeTTL,
+		MaxStale:     *maxStale,
+		MaxEntries:   *maxEntries,
+		ResolveHosts: *resolveHosts,
+		Resolvers:    splitList(*resolver),
+		DNSServers:   splitList(*dnsServers),
+		DNSTimeout:   *dnsTimeout,
+		MesosDNSURL:  *mesosDNSURL,
+		MarathonURL:  *marathonURL,
+		StaticFile:   *staticFile,
 		ListenSock:   querysock,
 		WriteSock:    portsock,
 		ProxyMode:    *proxyMode,
+		TLSPort:      *tlsBindPort,
+		BindAddr:     *bindAddr,
+		Forwards:     forwardList,
+		Prewarm:      splitList(*prewarm),
+
+		CacheSnapshot:         snapshot,
+		CacheSnapshotInterval: *cacheSnapshotInterval,
+		MarathonInterval:      *marathonInterval,
+		MarathonEvents:        *marathonEvents,
+		DefaultDomain:         *defaultDomain,
+		DefaultProto:          *defaultProto,
+	}
+	if *configFile != "" {
+		config, err := server.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.Config = config
+	}
+
+	// Shut down cleanly on signals so the cache snapshot gets written.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		if err := s.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+	if err := s.Run(*bindPort); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// splitList splits a comma separated flag value, an empty value results in
+// an empty list.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
 	}
-	log.Fatal(s.Run(*bindPort))
+	return strings.Split(value, ",")
 }
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dcos/octarine/srv"
+)
+
+// Config is the configuration file of the server, e.g.:
+//
+//	{
+//	  "services": {
+//	    "_kafka*._tcp.marathon.mesos": {"ttl": "1s", "policy": "round-robin"},
+//	    "_zk._tcp.marathon.mesos": {"ttl": "5m", "negative_ttl": "10s"},
+//	    "_legacy._tcp.marathon.mesos": {"targets": ["10.0.0.1:8080"]},
+//	    "_grpc-*._tcp.marathon.mesos": {"h2c": true}
+//	  },
+//	  "forwards": {
+//	    "localhost:5432": "_postgres._tcp.marathon.mesos"
+//	  }
+//	}
+type Config struct {
+	// Services maps name globs to the overrides of the names they match,
+	// when several globs match a name the one with the most characters
+	// outside of wildcards wins.
+	Services map[string]ServiceConfig `json:"services"`
+	// Forwards maps local "[addr:]port" addresses to the SRV names their
+	// connections are forwarded to.
+	Forwards map[string]string `json:"forwards"`
+}
+
+// ServiceConfig overrides how the names matching a glob are cached and
+// routed, durations are given as in time.ParseDuration.
+type ServiceConfig struct {
+	TTL         string   `json:"ttl"`
+	NegativeTTL string   `json:"negative_ttl"`
+	Policy      string   `json:"policy"`
+	Targets     []string `json:"targets"`
+	H2C         bool     `json:"h2c"`
+}
+
+// LoadConfig reads and validates the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if _, err := config.Overrides(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if _, err := config.ForwardList(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &config, nil
+}
+
+// ForwardList returns the forwards section as a list ordered by address.
+func (c *Config) ForwardList() ([]Forward, error) {
+	var forwards []Forward
+	for listen, name := range c.Forwards {
+		f, err := newForward(listen, name)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].Listen < forwards[j].Listen
+	})
+	return forwards, nil
+}
+
+// Overrides returns the service sections as SRV cache overrides.
+func (c *Config) Overrides() ([]srv.Override, error) {
+	var overrides []srv.Override
+	for pattern, service := range c.Services {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid service glob %q: %s", pattern, err)
+		}
+		// Names are matched in lower case.
+		ov := srv.Override{
+			Pattern: strings.ToLower(pattern),
+			Policy:  srv.Policy(service.Policy),
+			H2C:     service.H2C,
+		}
+		var err error
+		if ov.TTL, err = parseDuration(service.TTL); err != nil {
+			return nil, fmt.Errorf("%s: invalid ttl: %s", pattern, err)
+		}
+		if ov.NegativeTTL, err = parseDuration(service.NegativeTTL); err != nil {
+			return nil, fmt.Errorf("%s: invalid negative_ttl: %s", pattern, err)
+		}
+		if ov.Policy != "" && !srv.ValidPolicy(ov.Policy) {
+			return nil, fmt.Errorf("%s: %s is an invalid policy", pattern,
+				ov.Policy)
+		}
+		for _, target := range service.Targets {
+			addr, err := srv.ParseTarget(target)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", pattern, err)
+			}
+			ov.Targets = append(ov.Targets, addr)
+		}
+		overrides = append(overrides, ov)
+	}
+	return overrides, nil
+}
+
+// parseDuration parses an optional duration, an empty string is zero.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Forward is a local TCP listener whose connections are forwarded to the
+// targets of an SRV name.
+type Forward struct {
+	// Listen is the local address, e.g., "localhost:5432".
+	Listen string
+	// Name is the SRV name, e.g., "_postgres._tcp.marathon.mesos".
+	Name string
+}
+
+// ParseForward parses a forward given as "[addr:]port=name", e.g.,
+// "5432=_postgres._tcp.marathon.mesos", the address defaults to 127.0.0.1.
+func ParseForward(spec string) (Forward, error) {
+	i := strings.Index(spec, "=")
+	if i == -1 {
+		return Forward{}, fmt.Errorf("invalid forward %q, expected "+
+			"[addr:]port=name", spec)
+	}
+	return newForward(spec[:i], spec[i+1:])
+}
+
+func newForward(listen, name string) (Forward, error) {
+	if !strings.Contains(listen, ":") {
+		listen = net.JoinHostPort("127.0.0.1", listen)
+	}
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return Forward{}, fmt.Errorf("invalid forward address %q: %s", listen,
+			err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return Forward{}, fmt.Errorf("invalid forward port %q", port)
+	}
+	if name == "" {
+		return Forward{}, fmt.Errorf("missing name to forward %s to", listen)
+	}
+	return Forward{Listen: listen, Name: name}, nil
+}
+
+// listenForwards opens the listeners of the forwards, all of them or none.
+func listenForwards(forwards []Forward) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, f := range forwards {
+		netl, err := net.Listen("tcp", f.Listen)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, netl)
+	}
+	return listeners, nil
+}
+
+// runForward forwards every connection accepted on netl to a target of
+// name, picked from the cache for each connection.
+func (sv *Server) runForward(netl net.Listener, name string) {
+	sv.serve(netl, func(conn net.Conn) {
+		sv.handleForward(conn, name)
+	})
+}
+
+func (sv *Server) handleForward(conn net.Conn, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	host, port, err := sv.cache.Get(ctx, name)
+	if err != nil {
+		log.Print(err)
+		conn.Close()
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	var d net.Dialer
+	upstream, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		log.Print("dial error: ", err)
+		conn.Close()
+		return
+	}
+	if sv.Verbose {
+		log.Printf("forwarding %s to %s (%s)", conn.RemoteAddr(), addr, name)
+	}
+	splice(conn, upstream)
+}
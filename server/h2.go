@@ -0,0 +1,405 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dcos/octarine/srv"
+)
+
+// h2Preface is the client connection preface of HTTP/2.
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// HTTP/2 frame types and flags, and limits used here.
+const (
+	h2FrameHeaderLen = 9
+	h2FrameHeaders   = 0x1
+	h2FrameSettings  = 0x4
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	// h2MaxFrameSize is the largest frame every HTTP/2 peer accepts.
+	h2MaxFrameSize = 1 << 14
+)
+
+// h2cPrefaceTimeout bounds how long a client that upgraded to h2c may take
+// to send its connection preface.
+const h2cPrefaceTimeout = 10 * time.Second
+
+// newH2CTransport returns a transport that speaks HTTP/2 over cleartext
+// with prior knowledge, as gRPC services expect.
+func newH2CTransport() *http.Transport {
+	tr := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	tr.Protocols = new(http.Protocols)
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	return tr
+}
+
+// serverProtocols returns the protocols of the proxy listener: h2c with
+// prior knowledge is accepted in transparent mode on top of HTTP/1, the
+// h2c Upgrade is handled by createH2CUpgradeHandler.
+func serverProtocols(transparent bool) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(transparent)
+	return protocols
+}
+
+// enableUpstreamHTTP2 makes tr negotiate HTTP/2 with TLS upstreams that
+// support it, which a custom TLS config otherwise disables.
+func enableUpstreamHTTP2(tr *http.Transport) {
+	tr.ForceAttemptHTTP2 = true
+}
+
+// srvUpstreams picks the transport of the requests for SRV names. Cleartext
+// has no protocol negotiation, so h2c is only used for the names whose
+// service sets h2c in the config, any other request goes through http1.
+type srvUpstreams struct {
+	cache srv.Cache
+	h2c   *http.Transport
+	http1 http.RoundTripper
+}
+
+func newSRVUpstreams(cache srv.Cache, http1 http.RoundTripper) *srvUpstreams {
+	return &srvUpstreams{cache: cache, h2c: newH2CTransport(), http1: http1}
+}
+
+// transport returns the round tripper of the requests for name with the
+// given URL scheme.
+func (u *srvUpstreams) transport(name, scheme string) http.RoundTripper {
+	if scheme == "http" {
+		if ov, ok := u.cache.Override(name); ok && ov.H2C {
+			return u.h2c
+		}
+	}
+	return u.http1
+}
+
+// createH2Handler returns a handler that proxies the HTTP/2 requests for
+// SRV names to the selected target, every other request is served by next.
+//
+// Unlike goproxy, the reverse proxy streams the body and passes on
+// trailers, which gRPC clients of names like "_grpc-app._tcp.marathon.mesos"
+// rely on.
+func createH2Handler(next http.Handler, cache srv.Cache,
+	upstreams *srvUpstreams, transparent bool) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, ok := srvName(r, transparent)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host, port, err := cache.Get(r.Context(), name)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		out := r.Clone(r.Context())
+		if out.Host == "" {
+			out.Host = r.URL.Host
+		}
+		out.URL.Scheme = "http"
+		out.URL.Host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		rp := &httputil.ReverseProxy{
+			Director:      func(r *http.Request) {},
+			Transport:     upstreams.transport(name, out.URL.Scheme),
+			FlushInterval: -1,
+		}
+		rp.ServeHTTP(w, out)
+	})
+}
+
+// isH2CUpgrade returns true if r asks to upgrade to h2c, see RFC 7540
+// section 3.2.
+func isH2CUpgrade(r *http.Request) bool {
+	if r.ProtoMajor != 1 || !isUpgrade(r) ||
+		len(r.Header["Http2-Settings"]) != 1 {
+
+		return false
+	}
+	for _, token := range strings.Split(r.Header.Get("Upgrade"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "h2c") {
+			return true
+		}
+	}
+	return false
+}
+
+// createH2CUpgradeHandler returns a handler that upgrades HTTP/1 requests
+// asking for h2c to HTTP/2, every request on the upgraded connection,
+// starting with the one that asked for it, is served by next. The HTTP/2
+// server of the standard library only accepts h2c with prior knowledge, so
+// the upgrade request is replayed to it as stream 1 after the preface of
+// the client. Upgraded connections are tracked in conns. Other requests,
+// and upgrade requests with a body, are served by next over HTTP/1 as the
+// upgrade is optional.
+func createH2CUpgradeHandler(next http.Handler, conns *connSet) http.Handler {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isH2CUpgrade(r) || r.ContentLength != 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		settings, err := decodeH2CSettings(r.Header.Get("Http2-Settings"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		headers := encodeH2CRequest(r)
+		hijacker, ok := w.(http.Hijacker)
+		if !ok || len(headers) > h2MaxFrameSize {
+			next.ServeHTTP(w, r)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			log.Print("hijack error: ", err)
+			return
+		}
+		if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Connection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+
+			conn.Close()
+			return
+		}
+		prefix, err := readH2CPreface(conn, rw.Reader, settings, headers)
+		if err != nil {
+			log.Print("h2c upgrade error: ", err)
+			conn.Close()
+			return
+		}
+
+		upgraded := newH2CConn(conn, io.MultiReader(bytes.NewReader(prefix),
+			rw.Reader))
+		if !conns.add(upgraded) {
+			return
+		}
+		defer conns.remove(upgraded)
+		s := &http.Server{Handler: next, Protocols: protocols}
+		s.Serve(&connListener{conn: upgraded})
+	})
+}
+
+// decodeH2CSettings decodes the HTTP2-Settings header, the payload of a
+// SETTINGS frame in URL safe base64.
+func decodeH2CSettings(value string) ([]byte, error) {
+	settings, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimRight(value, "="))
+	if err != nil || len(settings)%6 != 0 {
+		return nil, errors.New("invalid HTTP2-Settings header")
+	}
+	return settings, nil
+}
+
+// readH2CPreface reads the preface of a client that upgraded to h2c and
+// returns it as the HTTP/2 server expects it: the connection preface, a
+// SETTINGS frame with the settings of the upgrade request updated with
+// those of the client, and the HEADERS frame of the upgrade request on
+// stream 1.
+// Merging the settings keeps the client at one SETTINGS acknowledgement, the
+// 101 response acknowledges the ones of the upgrade request.
+func readH2CPreface(conn net.Conn, r io.Reader, settings,
+	headers []byte) ([]byte, error) {
+
+	conn.SetReadDeadline(time.Now().Add(h2cPrefaceTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	preface := make([]byte, len(h2Preface)+h2FrameHeaderLen)
+	if _, err := io.ReadFull(r, preface); err != nil {
+		return nil, err
+	}
+	if string(preface[:len(h2Preface)]) != h2Preface {
+		return nil, errors.New("invalid connection preface")
+	}
+	header := preface[len(h2Preface):]
+	length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	if header[3] != h2FrameSettings || header[4]&h2FlagAck != 0 ||
+		length%6 != 0 || length > h2MaxFrameSize {
+
+		return nil, errors.New("connection preface without SETTINGS")
+	}
+	clientSettings := make([]byte, length)
+	if _, err := io.ReadFull(r, clientSettings); err != nil {
+		return nil, err
+	}
+
+	prefix := []byte(h2Preface)
+	prefix = appendH2Frame(prefix, h2FrameSettings, 0, 0,
+		mergeH2Settings(settings, clientSettings))
+	return appendH2Frame(prefix, h2FrameHeaders,
+		h2FlagEndStream|h2FlagEndHeaders, 1, headers), nil
+}
+
+// mergeH2Settings returns the SETTINGS payload of base updated with
+// settings. Every identifier is only sent once, which peers may require.
+func mergeH2Settings(base, settings []byte) []byte {
+	var merged []byte
+	for i := 0; i < len(base); i += 6 {
+		if !hasH2Setting(settings, base[i:i+2]) {
+			merged = append(merged, base[i:i+6]...)
+		}
+	}
+	for i := 0; i < len(settings); i += 6 {
+		if !hasH2Setting(settings[i+6:], settings[i:i+2]) {
+			merged = append(merged, settings[i:i+6]...)
+		}
+	}
+	return merged
+}
+
+// hasH2Setting returns true if the SETTINGS payload settings contains the
+// identifier id.
+func hasH2Setting(settings, id []byte) bool {
+	for i := 0; i < len(settings); i += 6 {
+		if bytes.Equal(settings[i:i+2], id) {
+			return true
+		}
+	}
+	return false
+}
+
+// h2cHopHeaders are the headers that don't apply to HTTP/2. TE is handled
+// by encodeH2CRequest as "trailers" is allowed.
+var h2cHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Http2-Settings":    true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// encodeH2CRequest returns the header block of r as an HTTP/2 request. The
+// fields are encoded as literals without indexing, which leaves the dynamic
+// table of the decoder unused.
+func encodeH2CRequest(r *http.Request) []byte {
+	authority := r.Host
+	if authority == "" {
+		authority = r.URL.Host
+	}
+	block := appendHPACKField(nil, ":method", r.Method)
+	block = appendHPACKField(block, ":scheme", "http")
+	block = appendHPACKField(block, ":authority", authority)
+	block = appendHPACKField(block, ":path", r.URL.RequestURI())
+	if acceptsTrailers(r.Header["Te"]) {
+		block = appendHPACKField(block, "te", "trailers")
+	}
+	for name, values := range r.Header {
+		if h2cHopHeaders[name] {
+			continue
+		}
+		for _, value := range values {
+			block = appendHPACKField(block, strings.ToLower(name), value)
+		}
+	}
+	return block
+}
+
+// acceptsTrailers returns true if the TE header values te list "trailers",
+// the only value of TE allowed in HTTP/2.
+func acceptsTrailers(te []string) bool {
+	for _, value := range te {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// appendHPACKField appends a literal header field without indexing and
+// with a new name, see RFC 7541 section 6.2.2.
+func appendHPACKField(b []byte, name, value string) []byte {
+	b = append(b, 0)
+	b = appendHPACKString(b, name)
+	return appendHPACKString(b, value)
+}
+
+func appendHPACKString(b []byte, s string) []byte {
+	// Strings aren't Huffman encoded, the length has a 7 bit prefix.
+	const max = 1<<7 - 1
+	n := len(s)
+	if n < max {
+		b = append(b, byte(n))
+	} else {
+		b = append(b, max)
+		for n -= max; n >= 0x80; n >>= 7 {
+			b = append(b, byte(n)|0x80)
+		}
+		b = append(b, byte(n))
+	}
+	return append(b, s...)
+}
+
+func appendH2Frame(b []byte, typ, flags byte, stream uint32,
+	payload []byte) []byte {
+
+	n := len(payload)
+	b = append(b, byte(n>>16), byte(n>>8), byte(n), typ, flags)
+	b = binary.BigEndian.AppendUint32(b, stream)
+	return append(b, payload...)
+}
+
+// h2cConn is an upgraded connection, reads start with the replayed preface.
+type h2cConn struct {
+	net.Conn
+	r      io.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newH2CConn(conn net.Conn, r io.Reader) *h2cConn {
+	return &h2cConn{Conn: conn, r: r, closed: make(chan struct{})}
+}
+
+func (c *h2cConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *h2cConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// connListener accepts its connection once, further calls block until it
+// is closed so that serving it ends with the connection.
+type connListener struct {
+	conn     *h2cConn
+	accepted bool
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.conn.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,484 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dcos/octarine/srv"
+	"github.com/elazarl/goproxy"
+)
+
+func TestDecodeH2CSettings(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []byte
+		err   bool
+	}{
+		{value: "", want: []byte{}},
+		{value: "AAMAAABkAAQAAP__", want: []byte{0, 3, 0, 0, 0, 100,
+			0, 4, 0, 0, 0xff, 0xff}},
+		{value: "AAMAAABk", want: []byte{0, 3, 0, 0, 0, 100}},
+		// Padding is tolerated although the header is sent without it.
+		{value: "AAMAAABk==", want: []byte{0, 3, 0, 0, 0, 100}},
+		{value: "AAMAAA", err: true},
+		{value: "AAMAAABk+/", err: true},
+		{value: "not base64!", err: true},
+	}
+	for _, test := range tests {
+		got, err := decodeH2CSettings(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("decodeH2CSettings(%q) = %v, want an error",
+					test.value, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, test.want) {
+			t.Errorf("decodeH2CSettings(%q) = %v, %v, want %v", test.value,
+				got, err, test.want)
+		}
+	}
+}
+
+// h2Setting returns the SETTINGS payload of a single setting.
+func h2Setting(id uint16, value uint32) []byte {
+	return []byte{byte(id >> 8), byte(id), byte(value >> 24),
+		byte(value >> 16), byte(value >> 8), byte(value)}
+}
+
+func TestMergeH2Settings(t *testing.T) {
+	concat := func(settings ...[]byte) []byte {
+		return bytes.Join(settings, nil)
+	}
+	tests := []struct {
+		name           string
+		base, settings []byte
+		want           []byte
+	}{
+		{name: "empty"},
+		{
+			name: "base only",
+			base: concat(h2Setting(3, 100), h2Setting(4, 65535)),
+			want: concat(h2Setting(3, 100), h2Setting(4, 65535)),
+		},
+		{
+			name:     "settings only",
+			settings: h2Setting(2, 0),
+			want:     h2Setting(2, 0),
+		},
+		{
+			name:     "settings replace base",
+			base:     concat(h2Setting(3, 100), h2Setting(4, 65535)),
+			settings: concat(h2Setting(4, 1<<20), h2Setting(2, 0)),
+			want: concat(h2Setting(3, 100), h2Setting(4, 1<<20),
+				h2Setting(2, 0)),
+		},
+		{
+			name:     "last duplicate wins",
+			base:     h2Setting(3, 100),
+			settings: concat(h2Setting(3, 10), h2Setting(3, 20)),
+			want:     h2Setting(3, 20),
+		},
+	}
+	for _, test := range tests {
+		got := mergeH2Settings(test.base, test.settings)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadH2CPreface(t *testing.T) {
+	settings := h2Setting(3, 100)
+	headers := []byte{0, 1, 'a', 1, 'b'}
+	// The settings of the client replace those of the upgrade request.
+	want := appendH2Frame([]byte(h2Preface), h2FrameSettings, 0, 0,
+		append(h2Setting(3, 10), h2Setting(4, 1<<20)...))
+	want = appendH2Frame(want, h2FrameHeaders,
+		h2FlagEndStream|h2FlagEndHeaders, 1, headers)
+
+	preface := func(prefix string, typ, flags byte, payload []byte) []byte {
+		return appendH2Frame([]byte(prefix), typ, flags, 0, payload)
+	}
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+	}{
+		{
+			name: "valid",
+			input: preface(h2Preface, h2FrameSettings, 0,
+				append(h2Setting(3, 10), h2Setting(4, 1<<20)...)),
+			want: want,
+		},
+		{
+			name: "invalid preface",
+			input: preface("GET / HTTP/1.1\r\n\r\n......", h2FrameSettings,
+				0, nil),
+		},
+		{
+			name:  "not SETTINGS",
+			input: preface(h2Preface, h2FrameHeaders, 0, nil),
+		},
+		{
+			name:  "SETTINGS acknowledgement",
+			input: preface(h2Preface, h2FrameSettings, h2FlagAck, nil),
+		},
+		{
+			name:  "invalid SETTINGS length",
+			input: preface(h2Preface, h2FrameSettings, 0, []byte{0, 3, 0}),
+		},
+		{
+			name: "truncated",
+			input: preface(h2Preface, h2FrameSettings, 0,
+				settings)[:len(h2Preface)+h2FrameHeaderLen+3],
+		},
+	}
+	for _, test := range tests {
+		conn, peer := net.Pipe()
+		got, err := readH2CPreface(conn, bytes.NewReader(test.input),
+			settings, headers)
+		conn.Close()
+		peer.Close()
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %v, %v, want %v", test.name, got, err,
+				test.want)
+		}
+	}
+}
+
+// decodeHPACKLiterals decodes a header block of literal fields without
+// indexing and with new names, as written by encodeH2CRequest.
+func decodeHPACKLiterals(block []byte) ([]string, error) {
+	var fields []string
+	for len(block) > 0 {
+		if block[0] != 0 {
+			return nil, fmt.Errorf("unexpected representation %#x", block[0])
+		}
+		block = block[1:]
+		var field [2]string
+		for i := range field {
+			if len(block) == 0 || block[0]&0x80 != 0 {
+				return nil, errors.New("missing or Huffman encoded string")
+			}
+			n := int(block[0] & 0x7f)
+			block = block[1:]
+			if n == 0x7f {
+				for shift := uint(0); ; shift += 7 {
+					if len(block) == 0 {
+						return nil, errors.New("truncated length")
+					}
+					c := block[0]
+					block = block[1:]
+					n += int(c&0x7f) << shift
+					if c&0x80 == 0 {
+						break
+					}
+				}
+			}
+			if len(block) < n {
+				return nil, errors.New("truncated string")
+			}
+			field[i], block = string(block[:n]), block[n:]
+		}
+		fields = append(fields, field[0]+": "+field[1])
+	}
+	return fields, nil
+}
+
+func TestEncodeH2CRequest(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	tests := []struct {
+		name   string
+		req    string
+		pseudo []string
+		fields []string
+	}{
+		{
+			name: "plain",
+			req:  "GET /a?b=c HTTP/1.1\r\nHost: _app._tcp.marathon.mesos\r\n",
+			pseudo: []string{":method: GET", ":scheme: http",
+				":authority: _app._tcp.marathon.mesos", ":path: /a?b=c"},
+		},
+		{
+			name: "connection specific headers dropped",
+			req: "OPTIONS * HTTP/1.1\r\nHost: app\r\n" +
+				"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n" +
+				"HTTP2-Settings: AAMAAABk\r\nKeep-Alive: 5\r\n" +
+				"Proxy-Connection: keep-alive\r\nX-Id: 1\r\nX-Id: 2\r\n",
+			pseudo: []string{":method: OPTIONS", ":scheme: http",
+				":authority: app", ":path: *"},
+			fields: []string{"x-id: 1", "x-id: 2"},
+		},
+		{
+			name: "TE trailers kept",
+			req:  "GET / HTTP/1.1\r\nHost: app\r\nTE: gzip, Trailers\r\n",
+			pseudo: []string{":method: GET", ":scheme: http",
+				":authority: app", ":path: /"},
+			fields: []string{"te: trailers"},
+		},
+		{
+			name: "other TE dropped",
+			req:  "GET / HTTP/1.1\r\nHost: app\r\nTE: gzip\r\n",
+			pseudo: []string{":method: GET", ":scheme: http",
+				":authority: app", ":path: /"},
+		},
+		{
+			name: "long value",
+			req:  "GET / HTTP/1.1\r\nHost: app\r\nX-Long: " + long + "\r\n",
+			pseudo: []string{":method: GET", ":scheme: http",
+				":authority: app", ":path: /"},
+			fields: []string{"x-long: " + long},
+		},
+	}
+	for _, test := range tests {
+		r, err := http.ReadRequest(bufio.NewReader(
+			strings.NewReader(test.req + "\r\n")))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		got, err := decodeHPACKLiterals(encodeH2CRequest(r))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(got) < len(test.pseudo) {
+			t.Errorf("%s: got %q, want %q first", test.name, got,
+				test.pseudo)
+			continue
+		}
+		pseudo, fields := got[:len(test.pseudo)], got[len(test.pseudo):]
+		sort.Strings(fields)
+		if strings.Join(pseudo, "\n") != strings.Join(test.pseudo, "\n") ||
+			strings.Join(fields, "\n") != strings.Join(test.fields, "\n") {
+
+			t.Errorf("%s: got %q, want %q and %q", test.name, got,
+				test.pseudo, test.fields)
+		}
+	}
+}
+
+// newProtoUpstream serves h2c with prior knowledge and HTTP/1, it answers
+// with the protocol, the path and the TE header of requests, and sets a
+// trailer.
+func newProtoUpstream(t *testing.T) string {
+	t.Helper()
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "Grpc-Status")
+			fmt.Fprintf(w, "%s %s te=%q", r.Proto, r.URL.Path,
+				r.Header.Get("Te"))
+			w.Header().Set("Grpc-Status", "0")
+		}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetHTTP1(true)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream.Listener.Addr().String()
+}
+
+// newHTTPProxy serves the proxy handlers of Run on a loopback port, the
+// SRV names "_grpc" and "_plain" go to the target upstream, only "_grpc"
+// over h2c.
+func newHTTPProxy(t *testing.T, upstream string, transparent bool) (
+	*connSet, string) {
+
+	t.Helper()
+	h2c := targetOverride(t, "_grpc._tcp.marathon.mesos", upstream)
+	h2c.H2C = true
+	cache := srv.New(srv.Config{
+		Timeout: time.Minute,
+		Overrides: []srv.Override{h2c,
+			targetOverride(t, "_plain._tcp.marathon.mesos", upstream)},
+		DefaultDomain: "marathon.mesos",
+		Resolver:      notFoundResolver{},
+	})
+	t.Cleanup(func() { cache.Close() })
+
+	conns := &connSet{}
+	proxy := goproxy.NewProxyHttpServer()
+	upstreams := newSRVUpstreams(cache, proxy.Tr)
+	proxy.NonproxyHandler = http.HandlerFunc(
+		createNonProxyHandler(proxy, "http"))
+	if transparent {
+		proxy.OnRequest(dstHasPort()).DoFunc(stripPort)
+	}
+	proxy.OnRequest(dstFirstCharMatch('_')).DoFunc(
+		createSRVHandler(cache, upstreams))
+	var handler http.Handler = createUpgradeHandler(
+		createH2Handler(proxy, cache, upstreams, transparent), cache,
+		conns, transparent)
+	if transparent {
+		handler = createH2CUpgradeHandler(handler, conns)
+	}
+	s := httptest.NewUnstartedServer(handler)
+	s.Config.Protocols = serverProtocols(transparent)
+	s.Start()
+	t.Cleanup(func() {
+		conns.close()
+		s.Close()
+	})
+	return conns, s.Listener.Addr().String()
+}
+
+// TestSRVHandlerTransport checks that only the names with h2c set are sent
+// over h2c, whatever the port in the request.
+func TestSRVHandlerTransport(t *testing.T) {
+	upstream := newProtoUpstream(t)
+	_, addr := newHTTPProxy(t, upstream, false)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+	}}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://_grpc._tcp.marathon.mesos/a", "HTTP/2.0 /a"},
+		{"http://_grpc:8080/b", "HTTP/2.0 /b"},
+		{"http://_plain._tcp.marathon.mesos:80/c", "HTTP/1.1 /c"},
+	}
+	for _, test := range tests {
+		resp, err := client.Get(test.url)
+		if err != nil {
+			t.Errorf("%s: %s", test.url, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK ||
+			!strings.HasPrefix(string(body), test.want) {
+
+			t.Errorf("%s: got %s %q, want %q", test.url, resp.Status, body,
+				test.want)
+		}
+	}
+}
+
+// readH2Frame reads a frame from r and returns its header fields and
+// payload.
+func readH2Frame(r io.Reader) (typ, flags byte, stream uint32,
+	payload []byte, err error) {
+
+	var header [h2FrameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, 0, nil, err
+	}
+	length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, 0, nil, err
+	}
+	stream = uint32(header[5]&0x7f)<<24 | uint32(header[6])<<16 |
+		uint32(header[7])<<8 | uint32(header[8])
+	return header[3], header[4], stream, payload, nil
+}
+
+// TestH2CUpgrade upgrades a connection to h2c and checks the response to
+// the upgrade request comes back on stream 1, with the target reached over
+// h2c only for the names that set it. Closing the tracked connections ends
+// the upgraded connection.
+func TestH2CUpgrade(t *testing.T) {
+	upstream := newProtoUpstream(t)
+	conns, addr := newHTTPProxy(t, upstream, true)
+	settings := base64.RawURLEncoding.EncodeToString(h2Setting(3, 100))
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"_grpc._tcp.marathon.mesos", `HTTP/2.0 /call te="trailers"`},
+		{"_plain:80", `HTTP/1.1 /call te="trailers"`},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET /call HTTP/1.1\r\nHost: %s\r\n"+
+			"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n"+
+			"HTTP2-Settings: %s\r\nTE: trailers\r\n\r\n", test.host, settings)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", test.host, err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%s: got %s, want 101", test.host, resp.Status)
+		}
+		preface := appendH2Frame([]byte(h2Preface), h2FrameSettings, 0, 0,
+			nil)
+		if _, err := conn.Write(preface); err != nil {
+			t.Fatal(err)
+		}
+
+		var body []byte
+		for {
+			typ, flags, stream, payload, err := readH2Frame(br)
+			if err != nil {
+				t.Fatalf("%s: %s, got %q so far", test.host, err, body)
+			}
+			// DATA frames of stream 1, the trailers end the stream.
+			if stream != 1 {
+				continue
+			}
+			if typ == 0x0 {
+				body = append(body, payload...)
+			}
+			if flags&h2FlagEndStream != 0 {
+				break
+			}
+		}
+		if string(body) != test.want {
+			t.Errorf("%s: got %q, want %q", test.host, body, test.want)
+		}
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: _grpc\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n"+
+		"HTTP2-Settings: %s\r\n\r\n", settings)
+	br := bufio.NewReader(conn)
+	if _, err := http.ReadResponse(br, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(appendH2Frame([]byte(h2Preface), h2FrameSettings, 0, 0, nil))
+	// Wait for the server SETTINGS, the connection is tracked by then.
+	if _, _, _, _, err := readH2Frame(br); err != nil {
+		t.Fatal(err)
+	}
+	conns.close()
+	for {
+		if _, _, _, _, err := readH2Frame(br); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("upgraded connection still open after close")
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"log"
+	"net"
+)
+
+// serveIntercept relays the connections redirected to netl, e.g., by an
+// iptables REDIRECT rule, to their original destination. The destination
+// is recovered from the connection itself, so any TCP protocol works and
+// Host headers are ignored. It blocks until the server is closed.
+func (sv *Server) serveIntercept(netl net.Listener) {
+	sv.serve(netl, func(conn net.Conn) {
+		sv.handleIntercept(conn.(*net.TCPConn))
+	})
+}
+
+func (sv *Server) handleIntercept(conn *net.TCPConn) {
+	dst, err := originalDst(conn)
+	if err != nil {
+		log.Print("intercept error: ", err)
+		conn.Close()
+		return
+	}
+	// A connection that wasn't redirected would be relayed to ourselves
+	// forever.
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok &&
+		local.IP.Equal(dst.IP) && local.Port == dst.Port {
+
+		log.Printf("intercept error: %s was not redirected", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", dst.String(), dialTimeout)
+	if err != nil {
+		log.Print("dial error: ", err)
+		conn.Close()
+		return
+	}
+	if sv.Verbose {
+		log.Printf("relaying %s to %s", conn.RemoteAddr(), dst)
+	}
+	splice(conn, upstream)
+}
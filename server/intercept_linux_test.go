@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// interceptDstEnv passes the destination to TestInterceptClient when it's
+// run inside the network namespace of TestIntercept.
+const interceptDstEnv = "OCTARINE_INTERCEPT_DST"
+
+// TestIntercept connects from a network namespace, through a veth pair, to
+// an upstream whose port is redirected to the intercept listener by
+// iptables, and checks the connection is relayed to the upstream.
+func TestIntercept(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	for _, tool := range []string{"ip", "iptables"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("requires %s", tool)
+		}
+	}
+	run := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %s\n%s", strings.Join(args, " "), err, out)
+		}
+		return string(out)
+	}
+	cleanup := func(args ...string) {
+		t.Cleanup(func() { exec.Command(args[0], args[1:]...).Run() })
+	}
+
+	const hostIP, nsIP = "10.213.0.1", "10.213.0.2"
+	id := os.Getpid() % 100000
+	ns := fmt.Sprintf("octarine-test-%d", id)
+	hostIf, nsIf := fmt.Sprintf("octh%d", id), fmt.Sprintf("octn%d", id)
+	run("ip", "netns", "add", ns)
+	cleanup("ip", "netns", "delete", ns)
+	run("ip", "link", "add", hostIf, "type", "veth", "peer", "name", nsIf,
+		"netns", ns)
+	cleanup("ip", "link", "delete", hostIf)
+	run("ip", "addr", "add", hostIP+"/24", "dev", hostIf)
+	run("ip", "link", "set", hostIf, "up")
+	run("ip", "netns", "exec", ns, "ip", "addr", "add", nsIP+"/24", "dev",
+		nsIf)
+	run("ip", "netns", "exec", ns, "ip", "link", "set", nsIf, "up")
+
+	// The upstream echoes what it gets along with the address it was
+	// connected from, which is the proxy's if the connection was relayed.
+	upstream, err := net.Listen("tcp", net.JoinHostPort(hostIP, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				from := conn.RemoteAddr().(*net.TCPAddr).IP
+				fmt.Fprintf(conn, "%s from %s", data, from)
+			}()
+		}
+	}()
+
+	netl, err := net.Listen("tcp", net.JoinHostPort(hostIP, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sv := &Server{ProxyMode: InterceptMode}
+	sv.closeLock.Lock()
+	sv.initClose()
+	sv.streamListener = netl
+	sv.closeLock.Unlock()
+	go sv.serveIntercept(netl)
+	defer sv.Close()
+
+	upstreamPort := strconv.Itoa(upstream.Addr().(*net.TCPAddr).Port)
+	proxyPort := strconv.Itoa(netl.Addr().(*net.TCPAddr).Port)
+	rule := []string{"PREROUTING", "-i", hostIf, "-p", "tcp", "--dport",
+		upstreamPort, "-j", "REDIRECT", "--to-ports", proxyPort}
+	run(append([]string{"iptables", "-t", "nat", "-A"}, rule...)...)
+	cleanup(append([]string{"iptables", "-t", "nat", "-D"}, rule...)...)
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0],
+		"-test.run=^TestInterceptClient$", "-test.v")
+	cmd.Env = append(os.Environ(),
+		interceptDstEnv+"="+net.JoinHostPort(hostIP, upstreamPort))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("client: %s\n%s", err, out)
+	}
+	if want := "ping from " + hostIP; !strings.Contains(string(out), want) {
+		t.Errorf("got %q, want %q from the relayed connection", out, want)
+	}
+}
+
+// TestInterceptClient is the client of TestIntercept, run in its network
+// namespace.
+func TestInterceptClient(t *testing.T) {
+	dst := os.Getenv(interceptDstEnv)
+	if dst == "" {
+		t.Skip("only run by TestIntercept")
+	}
+	conn, err := net.Dial("tcp", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println(string(resp))
+}
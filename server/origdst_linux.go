@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST of netfilter, also used as
+// IP6T_SO_ORIGINAL_DST at the IPv6 level.
+const soOriginalDst = 80
+
+// originalDst returns the destination a redirected connection was sent to
+// before netfilter redirected it.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := false
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		ipv6 = local.IP.To4() == nil
+	}
+
+	// The syscall package has no plain getsockopt that works on every
+	// architecture, so the getters of structures at least as large as the
+	// sockaddr_in and sockaddr_in6 filled in by netfilter are used.
+	var dst *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			var info *syscall.IPv6MTUInfo
+			info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd),
+				syscall.SOL_IPV6, soOriginalDst)
+			if sockErr != nil {
+				return
+			}
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, info.Addr.Addr[:])
+			// The port is stored in network byte order.
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:]
+			dst = &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port))}
+			return
+		}
+		var mreq *syscall.IPv6Mreq
+		mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP,
+			soOriginalDst)
+		if sockErr != nil {
+			return
+		}
+		// A sockaddr_in: family, port in network byte order and address.
+		sa := mreq.Multiaddr
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa[4:8])
+		port := binary.BigEndian.Uint16(sa[2:4])
+		dst = &net.TCPAddr{IP: ip, Port: int(port)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("SO_ORIGINAL_DST: %s", sockErr)
+	}
+	return dst, nil
+}
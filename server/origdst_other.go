@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDst is only supported on Linux, where netfilter records the
+// destination of redirected connections.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errors.New("intercept mode requires Linux")
+}
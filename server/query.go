@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dcos/octarine/srv"
+	"github.com/dcos/octarine/util"
+)
+
+// queryTimeout bounds how long a client may take to send its query.
+const queryTimeout = 10 * time.Second
+
+// handleQuery reads a query from fd and writes the response to the client
+// socket.
+func (sv *Server) handleQuery(fd net.Conn) {
+	defer fd.Close()
+	if err := fd.SetReadDeadline(time.Now().Add(queryTimeout)); err != nil {
+		log.Print("query error: ", err)
+		return
+	}
+	r := bufio.NewReader(fd)
+	// Older clients send a lone space, without a newline, to ask for the
+	// port.
+	b, err := r.Peek(1)
+	if err != nil {
+		log.Print("read error: ", err)
+		return
+	}
+	var line string
+	if b[0] == ' ' {
+		line = util.QueryPort
+	} else if line, err = r.ReadString('\n'); err != nil {
+		log.Print("read error: ", err)
+		return
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		fields = []string{util.QueryPort}
+	}
+	if fields[0] == util.QueryWatch {
+		sv.watch(fields[1:])
+		return
+	}
+	resp, err := sv.query(fields[0], fields[1:])
+	if err != nil {
+		resp = []byte(fmt.Sprintf("error: %s\n", err))
+	}
+	sv.writeResponse(resp)
+}
+
+func (sv *Server) query(cmd string, args []string) ([]byte, error) {
+	sv.closeLock.Lock()
+	cache := sv.cache
+	sv.closeLock.Unlock()
+
+	switch cmd {
+	case util.QueryPort:
+		return []byte(sv.port), nil
+	case util.QueryTLSPort:
+		if sv.tlsPort == "" {
+			return nil, fmt.Errorf("no TLS listener outside of transparent mode")
+		}
+		return []byte(sv.tlsPort), nil
+	case util.QueryEntries:
+		return json.MarshalIndent(cache.Entries(), "", "  ")
+	case util.QueryStats:
+		return json.MarshalIndent(cache.Stats(), "", "  ")
+	case util.QueryInvalidate:
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s requires a name", cmd)
+		}
+		for _, name := range args {
+			cache.Invalidate(name)
+		}
+		return []byte("ok\n"), nil
+	case util.QueryFlush:
+		cache.Flush()
+		return []byte("ok\n"), nil
+	case util.QueryPrewarm:
+		if err := cache.Prewarm(context.Background(), args); err != nil {
+			return nil, err
+		}
+		return []byte("ok\n"), nil
+	}
+	return nil, fmt.Errorf("unknown query %q", cmd)
+}
+
+// watch streams the changes to the record sets of names to the client
+// socket, one JSON event per line, until the client goes away or the server
+// is closed.
+func (sv *Server) watch(names []string) {
+	if len(names) == 0 {
+		sv.writeResponse([]byte(fmt.Sprintf("error: %s requires a name\n",
+			util.QueryWatch)))
+		return
+	}
+	sv.closeLock.Lock()
+	cache := sv.cache
+	sv.closeLock.Unlock()
+
+	netw, err := net.Dial("unix", sv.WriteSock)
+	if err != nil {
+		log.Print("dial error: ", err)
+		return
+	}
+	defer netw.Close()
+
+	events := make(chan srv.Event)
+	done := make(chan struct{})
+	defer close(done)
+	for _, name := range names {
+		ch, cancel := cache.Watch(name)
+		defer cancel()
+		go func() {
+			for ev := range ch {
+				select {
+				case events <- ev:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	// The client never writes, a read only returns once it's gone.
+	gone := make(chan struct{})
+	go func() {
+		ioutil.ReadAll(netw)
+		close(gone)
+	}()
+
+	enc := json.NewEncoder(netw)
+	for {
+		select {
+		case ev := <-events:
+			if err := enc.Encode(ev); err != nil {
+				log.Print("write error: ", err)
+				return
+			}
+		case <-gone:
+			return
+		case <-sv.closed:
+			return
+		}
+	}
+}
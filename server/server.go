@@ -1,12 +1,14 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dcos/octarine/srv"
@@ -20,19 +22,108 @@ var StandardMode = "standard"
 // TransparentMode indicates transparent forward proxy behavior
 var TransparentMode = "transparent"
 
+// InterceptMode indicates relaying connections redirected by netfilter to
+// their original destination
+var InterceptMode = "intercept"
+
+// SOCKS5Mode indicates SOCKS5 proxy behavior
+var SOCKS5Mode = "socks5"
+
 // ProxyModes is a slice of all proxy modes
-var ProxyModes = []string{StandardMode, TransparentMode}
+var ProxyModes = []string{StandardMode, TransparentMode, InterceptMode,
+	SOCKS5Mode}
+
+// SystemResolver indicates SRV lookups through the system resolver
+var SystemResolver = "system"
+
+// DNSResolver indicates SRV lookups through the configured DNS servers
+var DNSResolver = "dns"
+
+// MesosDNSResolver indicates SRV lookups through the Mesos-DNS HTTP API
+var MesosDNSResolver = "mesos-dns"
+
+// MarathonResolver indicates SRV lookups in the app table of Marathon
+var MarathonResolver = "marathon"
+
+// StaticResolver indicates SRV lookups in a static registry file
+var StaticResolver = "static"
+
+// Resolvers is a slice of all resolvers
+var Resolvers = []string{SystemResolver, DNSResolver, MesosDNSResolver,
+	MarathonResolver, StaticResolver}
+
+// staticReloadInterval is how often the static registry file is checked
+// for changes.
+const staticReloadInterval = time.Second
+
+// dialTimeout bounds how long connecting to an upstream, i.e., a selected
+// target or an intercepted destination, may take.
+const dialTimeout = 10 * time.Second
 
 // Server stores the server configuration
 type Server struct {
 	ID           string
 	Verbose      bool
 	CacheTimeout int
+	CacheMinTTL  int
+	CacheMaxTTL  int
+	NegativeTTL  int
+	MaxStale     int
+	MaxEntries   int
+	ResolveHosts bool
+	Resolvers    []string
+	DNSServers   []string
+	DNSTimeout   int
+	MesosDNSURL  string
+	MarathonURL  string
+	StaticFile   string
 	ListenSock   string
 	WriteSock    string
 	ProxyMode    string
+	Prewarm      []string
+	// TLSPort is the port of the TLS listener in transparent mode, 0 to pick
+	// any free port.
+	TLSPort int
+	// BindAddr is the address the proxy listeners are bound to, 127.0.0.1
+	// if it's empty.
+	BindAddr string
+	// Forwards are the TCP port forwards to SRV names, in addition to those
+	// of Config.
+	Forwards []Forward
+
+	// CacheSnapshot is the path of the SRV cache snapshot, empty to disable
+	// it.
+	CacheSnapshot         string
+	CacheSnapshotInterval int
+	// MarathonInterval is the number of seconds between polls of the
+	// Marathon apps, MarathonEvents enables following its event stream.
+	MarathonInterval int
+	MarathonEvents   bool
+	// DefaultDomain and DefaultProto complete short SRV names, e.g., "_app".
+	DefaultDomain string
+	DefaultProto  string
+	// Config is the loaded configuration file, if any.
+	Config *Config
+
+	port        string
+	tlsPort     string
+	cache       srv.Cache
+	server      *http.Server
+	listener    net.Listener
+	tlsListener net.Listener
+	closed      chan struct{}
+	closeLock   sync.Mutex
+	// done is closed once Close has finished, including saving the cache
+	// snapshot.
+	done chan struct{}
+	// conns are the connections handled outside of server, closed along
+	// with it.
+	conns *connSet
 
-	port string
+	// streamListener is the proxy listener in the modes that don't speak
+	// HTTP, where it's not served by server.
+	streamListener   net.Listener
+	forwardListeners []net.Listener
 }
 
 // ValidProxyMode returns true if the mode is a valid proxy mode, false
@@ -46,12 +137,61 @@ func ValidProxyMode(mode string) bool {
 	return false
 }
 
-// Run starts the server
+// ValidResolver returns true if the name is a valid resolver, false
+// otherwise.
+func ValidResolver(name string) bool {
+	for _, r := range Resolvers {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Run starts the server and blocks until it fails or is closed
 func (sv *Server) Run(inputPort int) error {
-	srvCache := srv.New(time.Duration(sv.CacheTimeout) * time.Second)
-	srvHandler := createSRVHandler(srvCache)
+	sv.closeLock.Lock()
+	sv.initClose()
+	sv.closeLock.Unlock()
 
+	// The config is validated before the resolvers start polling.
+	var overrides []srv.Override
+	var err error
+	forwards := sv.Forwards
+	if sv.Config != nil {
+		if overrides, err = sv.Config.Overrides(); err != nil {
+			return err
+		}
+		configForwards, err := sv.Config.ForwardList()
+		if err != nil {
+			return err
+		}
+		forwards = append(append([]Forward(nil), forwards...),
+			configForwards...)
+	}
+	resolver, err := sv.resolver()
+	if err != nil {
+		return err
+	}
+	srvCache := srv.New(srv.Config{
+		Timeout:        time.Duration(sv.CacheTimeout) * time.Second,
+		MinTTL:         time.Duration(sv.CacheMinTTL) * time.Second,
+		MaxTTL:         time.Duration(sv.CacheMaxTTL) * time.Second,
+		NegativeTTL:    time.Duration(sv.NegativeTTL) * time.Second,
+		MaxStale:       time.Duration(sv.MaxStale) * time.Second,
+		MaxEntries:     sv.MaxEntries,
+		ResolveTargets: sv.ResolveHosts,
+		Overrides:      overrides,
+		DefaultDomain:  sv.DefaultDomain,
+		DefaultProto:   sv.DefaultProto,
+		Resolver:       resolver,
+
+		SnapshotPath:     sv.CacheSnapshot,
+		SnapshotInterval: time.Duration(sv.CacheSnapshotInterval) * time.Second,
+	})
 	proxy := goproxy.NewProxyHttpServer()
+	upstreams := newSRVUpstreams(srvCache, proxy.Tr)
+	srvHandler := createSRVHandler(srvCache, upstreams)
 	httpProxifier := createNonProxyHandler(proxy, "http")
 	proxy.NonproxyHandler = http.HandlerFunc(httpProxifier)
 	if sv.ProxyMode == TransparentMode {
@@ -59,23 +199,249 @@ func (sv *Server) Run(inputPort int) error {
 		proxy.OnRequest(dstSuffixMatch(util.DcosDomain)).DoFunc(stripDcosDomain)
 	}
 	proxy.OnRequest(dstFirstCharMatch("_"[0])).DoFunc(srvHandler)
+	proxy.OnRequest(dstFirstCharMatch("_"[0])).HandleConnectFunc(
+		createSRVConnectHandler(srvCache))
 	proxy.Verbose = sv.Verbose
+	enableUpstreamHTTP2(proxy.Tr)
 
-	netl, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(inputPort)))
+	bindAddr := sv.BindAddr
+	if bindAddr == "" {
+		bindAddr = "127.0.0.1"
+	}
+	netl, err := net.Listen("tcp", net.JoinHostPort(bindAddr, strconv.Itoa(inputPort)))
 	if err != nil {
+		srvCache.Close()
 		return err
 	}
 	_, port, err := net.SplitHostPort(netl.Addr().String())
 	if err != nil {
+		netl.Close()
+		srvCache.Close()
 		return err
 	}
-	sv.port = port
+	var tlsl net.Listener
+	var tlsPort string
+	if sv.ProxyMode == TransparentMode {
+		tlsl, err = net.Listen("tcp",
+			net.JoinHostPort(bindAddr, strconv.Itoa(sv.TLSPort)))
+		if err != nil {
+			netl.Close()
+			srvCache.Close()
+			return err
+		}
+		_, tlsPort, _ = net.SplitHostPort(tlsl.Addr().String())
+	}
+	forwardls, err := listenForwards(forwards)
+	if err != nil {
+		netl.Close()
+		if tlsl != nil {
+			tlsl.Close()
+		}
+		srvCache.Close()
+		return err
+	}
+	transparent := sv.ProxyMode == TransparentMode
+	var handler http.Handler = createUpgradeHandler(
+		createH2Handler(proxy, srvCache, upstreams, transparent), srvCache,
+		sv.conns, transparent)
+	if transparent {
+		handler = createH2CUpgradeHandler(handler, sv.conns)
+	}
 	s := &http.Server{
-		Handler: proxy,
+		Handler:   handler,
+		Protocols: serverProtocols(transparent),
 	}
 
+	sv.closeLock.Lock()
+	select {
+	case <-sv.closed:
+		sv.closeLock.Unlock()
+		netl.Close()
+		if tlsl != nil {
+			tlsl.Close()
+		}
+		for _, l := range forwardls {
+			l.Close()
+		}
+		srvCache.Close()
+		return nil
+	default:
+	}
+	sv.port = port
+	sv.tlsPort = tlsPort
+	sv.cache = srvCache
+	sv.server = s
+	sv.tlsListener = tlsl
+	sv.forwardListeners = forwardls
+	if sv.ProxyMode == InterceptMode || sv.ProxyMode == SOCKS5Mode {
+		sv.streamListener = netl
+	}
+	sv.closeLock.Unlock()
+
+	if len(sv.Prewarm) > 0 {
+		go sv.prewarm()
+	}
 	go sv.runListener()
-	return s.Serve(netl)
+	if tlsl != nil {
+		go sv.runTLSListener(tlsl)
+	}
+	for i, l := range forwardls {
+		go sv.runForward(l, forwards[i].Name)
+	}
+	switch sv.ProxyMode {
+	case InterceptMode:
+		sv.serveIntercept(netl)
+	case SOCKS5Mode:
+		sv.serveSOCKS(netl)
+	default:
+		if err := s.Serve(netl); err != http.ErrServerClosed {
+			return err
+		}
+	}
+	// Only return once Close is done, so the snapshot is written before
+	// the process exits.
+	<-sv.done
+	return nil
+}
+
+// initClose creates the channels that track closing, closeLock must be
+// held.
+func (sv *Server) initClose() {
+	if sv.closed == nil {
+		sv.closed = make(chan struct{})
+		sv.done = make(chan struct{})
+		sv.conns = &connSet{}
+	}
+}
+
+// Close stops the server: the proxy, TLS, forward and query listeners are
+// closed along with the connections accepted on them, the background work
+// of the SRV cache is stopped and Run returns.
+func (sv *Server) Close() error {
+	sv.closeLock.Lock()
+	defer sv.closeLock.Unlock()
+	sv.initClose()
+	select {
+	case <-sv.closed:
+		return nil
+	default:
+	}
+	close(sv.closed)
+	defer close(sv.done)
+
+	var err error
+	if sv.server != nil {
+		err = sv.server.Close()
+	}
+	if sv.listener != nil {
+		sv.listener.Close()
+	}
+	if sv.tlsListener != nil {
+		sv.tlsListener.Close()
+	}
+	if sv.streamListener != nil {
+		sv.streamListener.Close()
+	}
+	for _, l := range sv.forwardListeners {
+		l.Close()
+	}
+	sv.conns.close()
+	if sv.cache != nil {
+		if cacheErr := sv.cache.Close(); err == nil {
+			err = cacheErr
+		}
+	}
+	return err
+}
+
+// ParseResolver splits a resolver given as "name" or "name=timeout", e.g.,
+// "mesos-dns=2s", and validates it.
+func ParseResolver(spec string) (name string, timeout time.Duration,
+	err error) {
+
+	name = spec
+	if i := strings.Index(spec, "="); i != -1 {
+		name = spec[:i]
+		if timeout, err = time.ParseDuration(spec[i+1:]); err != nil {
+			return "", 0, fmt.Errorf("invalid timeout for resolver %s: %s",
+				name, err)
+		}
+	}
+	if !ValidResolver(name) {
+		return "", 0, fmt.Errorf("%s is an invalid resolver", name)
+	}
+	return name, timeout, nil
+}
+
+// resolver returns the resolver for SRV lookups, several resolvers or one
+// with a timeout are chained. If a resolver can't be created, those already
+// created are closed.
+func (sv *Server) resolver() (srv.Resolver, error) {
+	var backends []srv.Backend
+	for _, spec := range sv.Resolvers {
+		name, timeout, err := ParseResolver(spec)
+		if err != nil {
+			srv.NewChain(backends...).Close()
+			return nil, err
+		}
+		r, err := sv.newResolver(name)
+		if err != nil {
+			srv.NewChain(backends...).Close()
+			return nil, err
+		}
+		backends = append(backends,
+			srv.Backend{Name: name, Resolver: r, Timeout: timeout})
+	}
+	switch {
+	case len(backends) == 0:
+		return srv.SystemResolver(), nil
+	case len(backends) == 1 && backends[0].Timeout == 0:
+		return backends[0].Resolver, nil
+	}
+	return srv.NewChain(backends...), nil
+}
+
+func (sv *Server) newResolver(name string) (srv.Resolver, error) {
+	timeout := time.Duration(sv.DNSTimeout) * time.Second
+	switch name {
+	case DNSResolver:
+		return srv.NewDNSResolver(sv.DNSServers, timeout), nil
+	case MesosDNSResolver:
+		return srv.NewMesosDNSResolver(sv.MesosDNSURL,
+			&http.Client{Timeout: timeout}), nil
+	case MarathonResolver:
+		return srv.NewMarathonResolver(sv.MarathonURL,
+			&http.Client{Timeout: timeout},
+			time.Duration(sv.MarathonInterval)*time.Second,
+			sv.MarathonEvents), nil
+	case StaticResolver:
+		return srv.NewStaticResolver(sv.StaticFile, staticReloadInterval)
+	}
+	return srv.SystemResolver(), nil
+}
+
+func (sv *Server) prewarm() {
+	if err := sv.cache.Prewarm(context.Background(), sv.Prewarm); err != nil {
+		log.Print("prewarm error: ", err)
+	}
+}
+
+// upstreamAddr returns the address to connect to for host and port. Hosts
+// are handled like those of transparent HTTP requests: the DC/OS domain is
+// stripped and SRV names are resolved through cache, in which case the port
+// of the selected target replaces port.
+func upstreamAddr(ctx context.Context, cache srv.Cache, host, port string) (
+	string, error) {
+
+	host = strings.TrimSuffix(strings.TrimSuffix(host, "."), util.DcosDomain)
+	if !strings.HasPrefix(host, "_") {
+		return net.JoinHostPort(host, port), nil
+	}
+	target, srvPort, err := cache.Get(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(target, strconv.Itoa(int(srvPort))), nil
 }
 
 func stripDcosDomain(r *http.Request, ctx *goproxy.ProxyCtx) (
@@ -110,22 +476,68 @@ func dstFirstCharMatch(char byte) goproxy.ReqConditionFunc {
 	}
 }
 
-func createSRVHandler(cache srv.Cache) func(
+func createSRVHandler(cache srv.Cache, upstreams *srvUpstreams) func(
 	r *http.Request, ctx *goproxy.ProxyCtx) (
 	*http.Request, *http.Response) {
 
 	return func(r *http.Request, ctx *goproxy.ProxyCtx) (
 		*http.Request, *http.Response) {
 
-		if host, port, err := cache.Get(r.URL.Host); err != nil {
+		// The port of the request, if any, is replaced by the one of the
+		// target.
+		name := r.URL.Host
+		if host, _, err := net.SplitHostPort(name); err == nil {
+			name = host
+		}
+		host, port, err := cache.Get(r.Context(), name)
+		if err != nil {
+			// Fail fast, forwarding the request to the unresolved name can
+			// only fail as well.
 			log.Print(err)
-		} else {
-			r.URL.Host = fmt.Sprintf("%s:%d", host, port)
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText,
+				http.StatusBadGateway, err.Error())
 		}
+		// Only the URL is rewritten, the Host header keeps the service name.
+		r.URL.Host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		tr := upstreams.transport(name, r.URL.Scheme)
+		ctx.RoundTripper = goproxy.RoundTripperFunc(
+			func(r *http.Request, ctx *goproxy.ProxyCtx) (
+				*http.Response, error) {
+
+				return tr.RoundTrip(r)
+			})
 		return r, nil
 	}
 }
 
+// createSRVConnectHandler returns a handler that tunnels CONNECT requests
+// for SRV names, e.g., "_app._tcp.marathon.mesos:443", to the selected
+// target. The port of the request is replaced by the one of the target.
+func createSRVConnectHandler(cache srv.Cache) func(
+	host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+
+	return func(host string, ctx *goproxy.ProxyCtx) (
+		*goproxy.ConnectAction, string) {
+
+		name, port, err := net.SplitHostPort(host)
+		if err != nil {
+			name, port = host, "443"
+		}
+		addr, err := upstreamAddr(ctx.Req.Context(), cache, name, port)
+		if err != nil {
+			// The client connection is already hijacked, goproxy writes
+			// ctx.Resp to it when rejecting.
+			log.Print(err)
+			resp := goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText,
+				http.StatusBadGateway, err.Error())
+			resp.ProtoMajor, resp.ProtoMinor = 1, 1
+			ctx.Resp = resp
+			return goproxy.RejectConnect, host
+		}
+		return goproxy.OkConnect, addr
+	}
+}
+
 func createNonProxyHandler(proxy *goproxy.ProxyHttpServer,
 	trafficType string) func(w http.ResponseWriter, req *http.Request) {
 
@@ -141,14 +553,14 @@ func createNonProxyHandler(proxy *goproxy.ProxyHttpServer,
 	}
 }
 
-func (sv *Server) writeResponse() {
+func (sv *Server) writeResponse(resp []byte) {
 	netw, err := net.Dial("unix", sv.WriteSock)
 	if err != nil {
 		log.Print("dial error: ", err)
 		return
 	}
 	defer netw.Close()
-	_, err = netw.Write([]byte(sv.port))
+	_, err = netw.Write(resp)
 	if err != nil {
 		log.Print("write error: ", err)
 		return
@@ -164,12 +576,81 @@ func (sv *Server) runListener() {
 	if err != nil {
 		log.Fatal("listen error: ", err)
 	}
+	sv.closeLock.Lock()
+	select {
+	case <-sv.closed:
+		sv.closeLock.Unlock()
+		netl.Close()
+		return
+	default:
+	}
+	sv.listener = netl
+	sv.closeLock.Unlock()
+
+	sv.serve(netl, sv.handleQuery)
+}
+
+// serve runs handle in a new goroutine for every connection accepted on
+// netl until the server is closed, which closes the connections still
+// being handled.
+func (sv *Server) serve(netl net.Listener, handle func(net.Conn)) {
 	for {
-		_, err := netl.Accept()
+		conn, err := netl.Accept()
 		if err != nil {
+			select {
+			case <-sv.closed:
+				return
+			default:
+			}
 			log.Print("accept error: ", err)
 			continue
 		}
-		go sv.writeResponse()
+		go func() {
+			if !sv.conns.add(conn) {
+				return
+			}
+			defer sv.conns.remove(conn)
+			handle(conn)
+		}()
+	}
+}
+
+// connSet tracks connections so they can be closed together.
+type connSet struct {
+	lock   sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// add tracks conn, if the set is already closed conn is closed and false
+// is returned.
+func (s *connSet) add(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *connSet) remove(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, conn)
+}
+
+// close closes the tracked connections and every connection added later.
+func (s *connSet) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
 	}
+	s.conns = nil
 }
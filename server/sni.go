@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// helloTimeout bounds how long a client may take to send its ClientHello.
+const helloTimeout = 10 * time.Second
+
+// tlsDefaultPort is the port TLS connections are forwarded to when the
+// server name is not an SRV name.
+const tlsDefaultPort = "443"
+
+// errHelloRead stops the handshake once the ClientHello has been read.
+var errHelloRead = errors.New("ClientHello read")
+
+// recordingConn is a read only connection that keeps what has been read, so
+// it can be replayed to the upstream.
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buf.Write(p[:n])
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// readServerName reads the ClientHello from conn without answering it and
+// returns the SNI server name along with the bytes read.
+func readServerName(conn net.Conn) (string, []byte, error) {
+	rec := &recordingConn{Conn: conn}
+	var name string
+	err := tls.Server(rec, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (
+			*tls.Config, error) {
+
+			name = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if name == "" {
+		if err == nil || err == errHelloRead {
+			err = errors.New("no server name in ClientHello")
+		}
+		return "", nil, err
+	}
+	return name, rec.buf.Bytes(), nil
+}
+
+// runTLSListener forwards the TLS connections accepted on netl to the
+// service named by their SNI server name, without terminating TLS. Names
+// are handled like the hosts of transparent HTTP requests: the DC/OS domain
+// is stripped and SRV names are resolved through the cache, other names are
+// connected to on port 443.
+func (sv *Server) runTLSListener(netl net.Listener) {
+	sv.serve(netl, sv.handleTLS)
+}
+
+func (sv *Server) handleTLS(conn net.Conn) {
+	if err := conn.SetReadDeadline(time.Now().Add(helloTimeout)); err != nil {
+		log.Print("TLS error: ", err)
+		conn.Close()
+		return
+	}
+	name, hello, err := readServerName(conn)
+	if err != nil {
+		log.Print("TLS error: ", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), helloTimeout)
+	defer cancel()
+	addr, err := upstreamAddr(ctx, sv.cache, name, tlsDefaultPort)
+	if err != nil {
+		log.Print(err)
+		conn.Close()
+		return
+	}
+	var d net.Dialer
+	upstream, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		log.Print("dial error: ", err)
+		conn.Close()
+		return
+	}
+	if sv.Verbose {
+		log.Printf("forwarding TLS for %s to %s", name, addr)
+	}
+	if _, err := upstream.Write(hello); err != nil {
+		log.Print("write error: ", err)
+		upstream.Close()
+		conn.Close()
+		return
+	}
+	splice(conn, upstream)
+}
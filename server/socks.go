@@ -0,0 +1,403 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928.
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksSucceeded          = 0
+	socksGeneralFailure     = 1
+	socksHostUnreachable    = 4
+	socksCmdNotSupported    = 7
+	socksAtypNotSupported   = 8
+	socksMaxUDPDatagramSize = 64 * 1024
+)
+
+// socksHandshakeTimeout bounds how long a client may take to send its
+// request.
+const socksHandshakeTimeout = 10 * time.Second
+
+// Limits of the datagrams of a UDP association held while their
+// destinations are resolved, more are dropped.
+const (
+	socksMaxPendingLookups   = 16
+	socksMaxPendingDatagrams = 16
+)
+
+var errSocksAtyp = errors.New("unsupported SOCKS address type")
+
+// serveSOCKS answers SOCKS5 clients on netl until the server is closed.
+// Only the CONNECT and UDP ASSOCIATE commands without authentication are
+// supported.
+func (sv *Server) serveSOCKS(netl net.Listener) {
+	sv.serve(netl, sv.handleSOCKS)
+}
+
+func (sv *Server) handleSOCKS(conn net.Conn) {
+	deadline := time.Now().Add(socksHandshakeTimeout)
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		log.Print("SOCKS error: ", err)
+		conn.Close()
+		return
+	}
+	r := bufio.NewReader(conn)
+	cmd, dst, err := socksHandshake(r, conn)
+	if err != nil {
+		log.Print("SOCKS error: ", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch cmd {
+	case socksCmdConnect:
+		sv.socksConnect(conn, r, dst)
+	case socksCmdUDPAssociate:
+		sv.socksAssociate(conn)
+	default:
+		writeSOCKSReply(conn, socksCmdNotSupported, nil)
+		conn.Close()
+	}
+}
+
+// socksHandshake negotiates the authentication method and reads the
+// request, it returns the command and the destination as "host:port".
+func socksHandshake(r *bufio.Reader, w io.Writer) (
+	cmd byte, dst string, err error) {
+
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, "", err
+	}
+	if head[0] != socksVersion {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return 0, "", err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := w.Write([]byte{socksVersion, method}); err != nil {
+		return 0, "", err
+	}
+	if method == socksNoAcceptable {
+		return 0, "", errors.New("SOCKS client requires authentication")
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return 0, "", err
+	}
+	if req[0] != socksVersion {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+	dst, err = readSOCKSAddr(r)
+	if err == errSocksAtyp {
+		writeSOCKSReply(w, socksAtypNotSupported, nil)
+	}
+	return req[1], dst, err
+}
+
+// readSOCKSAddr reads an address in the SOCKS format: its type, the
+// address itself and the port.
+func readSOCKSAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", errSocksAtyp
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host,
+		strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendSOCKSAddr appends addr in the SOCKS format, the unspecified IPv4
+// address is used if addr is nil.
+func appendSOCKSAddr(b []byte, addr net.Addr) []byte {
+	ip, port := net.IPv4zero, 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+func writeSOCKSReply(w io.Writer, rep byte, bound net.Addr) error {
+	_, err := w.Write(appendSOCKSAddr([]byte{socksVersion, rep, 0}, bound))
+	return err
+}
+
+// socksUpstream returns the address to connect to for the destination
+// requested by a SOCKS client.
+func (sv *Server) socksUpstream(ctx context.Context, dst string) (
+	string, error) {
+
+	host, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		return "", err
+	}
+	return upstreamAddr(ctx, sv.cache, host, port)
+}
+
+func (sv *Server) socksConnect(conn net.Conn, r *bufio.Reader, dst string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	addr, err := sv.socksUpstream(ctx, dst)
+	if err != nil {
+		log.Print(err)
+		writeSOCKSReply(conn, socksHostUnreachable, nil)
+		conn.Close()
+		return
+	}
+	var d net.Dialer
+	upstream, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		log.Print("dial error: ", err)
+		writeSOCKSReply(conn, socksHostUnreachable, nil)
+		conn.Close()
+		return
+	}
+	if err := writeSOCKSReply(conn, socksSucceeded,
+		upstream.LocalAddr()); err != nil {
+
+		upstream.Close()
+		conn.Close()
+		return
+	}
+	if sv.Verbose {
+		log.Printf("SOCKS connecting %s to %s", conn.RemoteAddr(), addr)
+	}
+	// The client may have pipelined data behind its request.
+	if n := r.Buffered(); n > 0 {
+		buffered, _ := r.Peek(n)
+		if _, err := upstream.Write(buffered); err != nil {
+			upstream.Close()
+			conn.Close()
+			return
+		}
+	}
+	splice(conn, upstream)
+}
+
+// socksAssociate relays the UDP datagrams of the client through a new UDP
+// socket for as long as its control connection stays open.
+func (sv *Server) socksAssociate(conn net.Conn) {
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.TCPAddr)
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		log.Print("SOCKS error: ", err)
+		writeSOCKSReply(conn, socksGeneralFailure, nil)
+		return
+	}
+	defer udp.Close()
+	if err := writeSOCKSReply(conn, socksSucceeded, udp.LocalAddr()); err != nil {
+		return
+	}
+	a := &udpAssociation{
+		sv:       sv,
+		udp:      udp,
+		clientIP: conn.RemoteAddr().(*net.TCPAddr).IP,
+		resolved: make(map[string]*net.UDPAddr),
+		pending:  make(map[string][][]byte),
+		peers:    make(map[string]bool),
+		lock:     &sync.Mutex{},
+	}
+	go a.relay()
+
+	// The association ends when the control connection closes.
+	io.Copy(ioutil.Discard, conn)
+}
+
+// udpAssociation is the state of a UDP ASSOCIATE request. Destinations are
+// resolved once per association, and only the replies of the peers the
+// client has sent to are relayed back.
+type udpAssociation struct {
+	sv       *Server
+	udp      *net.UDPConn
+	clientIP net.IP
+
+	client   *net.UDPAddr
+	resolved map[string]*net.UDPAddr
+	// pending are the payloads waiting for the lookup of their destination.
+	pending map[string][][]byte
+	peers   map[string]bool
+	lock    *sync.Mutex
+}
+
+// relay forwards the datagrams of the client to their destinations and
+// wraps the replies for the client, until the socket is closed.
+func (a *udpAssociation) relay() {
+	buf := make([]byte, socksMaxUDPDatagramSize)
+	for {
+		n, from, err := a.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		a.lock.Lock()
+		client, isPeer := a.client, a.peers[from.String()]
+		if from.IP.Equal(a.clientIP) && (client == nil || from.Port == client.Port) {
+			a.client = from
+			a.lock.Unlock()
+			a.forward(buf[:n])
+			continue
+		}
+		a.lock.Unlock()
+		if client == nil || !isPeer {
+			continue
+		}
+		packet := appendSOCKSAddr([]byte{0, 0, 0}, from)
+		packet = append(packet, buf[:n]...)
+		if _, err := a.udp.WriteToUDP(packet, client); err != nil {
+			log.Print("SOCKS UDP error: ", err)
+		}
+	}
+}
+
+// forward sends the payload of a client datagram to its destination, a
+// destination that isn't resolved yet is resolved once without holding up
+// the other datagrams.
+func (a *udpAssociation) forward(packet []byte) {
+	// Fragmented datagrams are not supported and dropped.
+	if len(packet) < 4 || packet[2] != 0 {
+		return
+	}
+	r := bytes.NewReader(packet[3:])
+	dst, err := readSOCKSAddr(r)
+	if err != nil {
+		return
+	}
+	payload := packet[len(packet)-r.Len():]
+
+	a.lock.Lock()
+	addr, ok := a.resolved[dst]
+	if ok {
+		a.lock.Unlock()
+		a.send(addr, payload)
+		return
+	}
+	payloads, inFlight := a.pending[dst]
+	switch {
+	case inFlight && len(payloads) < socksMaxPendingDatagrams:
+		a.pending[dst] = append(payloads, append([]byte(nil), payload...))
+	case !inFlight && len(a.pending) < socksMaxPendingLookups:
+		a.pending[dst] = [][]byte{append([]byte(nil), payload...)}
+		go a.flush(dst)
+	}
+	a.lock.Unlock()
+}
+
+// flush resolves dst and sends the payloads waiting for it, they are
+// dropped if it can't be resolved.
+func (a *udpAssociation) flush(dst string) {
+	addr, err := a.resolve(dst)
+	a.lock.Lock()
+	if err == nil {
+		a.resolved[dst] = addr
+	}
+	payloads := a.pending[dst]
+	delete(a.pending, dst)
+	a.lock.Unlock()
+	if err != nil {
+		log.Print("SOCKS UDP error: ", err)
+		return
+	}
+	for _, payload := range payloads {
+		a.send(addr, payload)
+	}
+}
+
+func (a *udpAssociation) resolve(dst string) (*net.UDPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	upstream, err := a.sv.socksUpstream(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0].IP, Port: portNum, Zone: ips[0].Zone}, nil
+}
+
+func (a *udpAssociation) send(addr *net.UDPAddr, payload []byte) {
+	a.lock.Lock()
+	a.peers[addr.String()] = true
+	a.lock.Unlock()
+	if _, err := a.udp.WriteToUDP(payload, addr); err != nil {
+		log.Print("SOCKS UDP error: ", err)
+	}
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dcos/octarine/srv"
+)
+
+// notFoundResolver doesn't know any name, only overrides with targets
+// resolve.
+type notFoundResolver struct{}
+
+func (notFoundResolver) LookupSRV(ctx context.Context, name string) (
+	[]*net.SRV, time.Duration, error) {
+
+	return nil, 0, &net.DNSError{Err: "not found", Name: name,
+		IsNotFound: true}
+}
+
+// newSOCKSServer serves SOCKS5 on a loopback port and returns its address.
+// SRV names are only resolved through overrides.
+func newSOCKSServer(t *testing.T, overrides ...srv.Override) (
+	*Server, string) {
+
+	t.Helper()
+	netl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sv := &Server{ProxyMode: SOCKS5Mode}
+	sv.closeLock.Lock()
+	sv.initClose()
+	sv.cache = srv.New(srv.Config{
+		Timeout:   time.Minute,
+		Overrides: overrides,
+		Resolver:  notFoundResolver{},
+	})
+	sv.streamListener = netl
+	sv.closeLock.Unlock()
+	go sv.serveSOCKS(netl)
+	t.Cleanup(func() { sv.Close() })
+	return sv, netl.Addr().String()
+}
+
+func targetOverride(t *testing.T, pattern, target string) srv.Override {
+	t.Helper()
+	addr, err := srv.ParseTarget(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv.Override{Pattern: pattern, Targets: []*net.SRV{addr}}
+}
+
+// socksDomain encodes name and port as a SOCKS address.
+func socksDomain(name string, port int) []byte {
+	b := append([]byte{socksAtypDomain, byte(len(name))}, name...)
+	return append(b, byte(port>>8), byte(port))
+}
+
+// socksRequest sends the request cmd for the SOCKS address dst to the
+// server at addr, it returns the control connection, the reply code and the
+// bound address.
+func socksRequest(t *testing.T, addr string, cmd byte, dst []byte) (
+	net.Conn, byte, string) {
+
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := append([]byte{socksVersion, 1, socksNoAuth,
+		socksVersion, cmd, 0}, dst...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	var resp [5]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp[:2], []byte{socksVersion, socksNoAuth}) {
+		t.Fatalf("got method reply %v", resp[:2])
+	}
+	bound, err := readSOCKSAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, resp[3], bound
+}
+
+// tcpEcho serves a loopback TCP port that echoes everything back.
+func tcpEcho(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestReadSOCKSAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+		err  bool
+	}{
+		{"IPv4", []byte{socksAtypIPv4, 10, 0, 0, 1, 0x1f, 0x90},
+			"10.0.0.1:8080", false},
+		{"IPv6", append(append([]byte{socksAtypIPv6},
+			net.ParseIP("fd00::1")...), 0, 80), "[fd00::1]:80", false},
+		{"domain", socksDomain("_app._tcp.marathon.mesos", 443),
+			"_app._tcp.marathon.mesos:443", false},
+		{"unsupported type", []byte{2, 0, 0}, "", true},
+		{"short address", []byte{socksAtypIPv4, 10, 0}, "", true},
+		{"short domain", []byte{socksAtypDomain, 5, 'a'}, "", true},
+		{"missing port", []byte{socksAtypIPv4, 10, 0, 0, 1}, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readSOCKSAddr(bytes.NewReader(test.in))
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %t", err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSOCKSHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		written []byte
+		cmd     byte
+		dst     string
+		err     bool
+	}{
+		{
+			name: "connect",
+			in: []byte{socksVersion, 2, 2, socksNoAuth,
+				socksVersion, socksCmdConnect, 0,
+				socksAtypIPv4, 127, 0, 0, 1, 0, 80},
+			written: []byte{socksVersion, socksNoAuth},
+			cmd:     socksCmdConnect,
+			dst:     "127.0.0.1:80",
+		},
+		{
+			name:    "authentication required",
+			in:      []byte{socksVersion, 1, 2},
+			written: []byte{socksVersion, socksNoAcceptable},
+			err:     true,
+		},
+		{
+			name: "SOCKS4",
+			in:   []byte{4, 1, 0, 80, 127, 0, 0, 1, 0},
+			err:  true,
+		},
+		{
+			name: "unsupported address type",
+			in: []byte{socksVersion, 1, socksNoAuth,
+				socksVersion, socksCmdConnect, 0, 2},
+			written: []byte{socksVersion, socksNoAuth,
+				socksVersion, socksAtypNotSupported, 0,
+				socksAtypIPv4, 0, 0, 0, 0, 0, 0},
+			cmd: socksCmdConnect,
+			err: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w bytes.Buffer
+			cmd, dst, err := socksHandshake(
+				bufio.NewReader(bytes.NewReader(test.in)), &w)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %t", err, test.err)
+			}
+			if cmd != test.cmd || dst != test.dst {
+				t.Errorf("got command %d to %q, want %d to %q", cmd, dst,
+					test.cmd, test.dst)
+			}
+			if !bytes.Equal(w.Bytes(), test.written) {
+				t.Errorf("wrote %v, want %v", w.Bytes(), test.written)
+			}
+		})
+	}
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	echo := tcpEcho(t)
+	_, addr := newSOCKSServer(t,
+		targetOverride(t, "_echo._tcp.marathon.mesos", echo))
+	_, echoPort, _ := net.SplitHostPort(echo)
+	var port int
+	fmt.Sscan(echoPort, &port)
+
+	tests := []struct {
+		name string
+		dst  []byte
+	}{
+		// The port of SRV names is replaced by the one of the target.
+		{"SRV name", socksDomain("_echo._tcp.marathon.mesos", 1)},
+		{"SRV name in the DC/OS domain",
+			socksDomain("_echo._tcp.marathon.mesos.mydcos.directory", 1)},
+		{"IP address", []byte{socksAtypIPv4, 127, 0, 0, 1,
+			byte(port >> 8), byte(port)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, rep, _ := socksRequest(t, addr, socksCmdConnect, test.dst)
+			if rep != socksSucceeded {
+				t.Fatalf("got reply %d, want success", rep)
+			}
+			io.WriteString(conn, "ping")
+			conn.(*net.TCPConn).CloseWrite()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "ping" {
+				t.Errorf("got %q, want the echo of ping", got)
+			}
+		})
+	}
+
+	_, rep, _ := socksRequest(t, addr, socksCmdConnect,
+		socksDomain("_unknown._tcp.marathon.mesos", 80))
+	if rep != socksHostUnreachable {
+		t.Errorf("unknown name: got reply %d, want host unreachable", rep)
+	}
+}
+
+func TestSOCKSCloseEndsConnections(t *testing.T) {
+	echo := tcpEcho(t)
+	sv, addr := newSOCKSServer(t,
+		targetOverride(t, "_echo._tcp.marathon.mesos", echo))
+	conn, rep, _ := socksRequest(t, addr, socksCmdConnect,
+		socksDomain("_echo._tcp.marathon.mesos", 1))
+	if rep != socksSucceeded {
+		t.Fatalf("got reply %d, want success", rep)
+	}
+	// Wait for the connection to be relayed before closing the server.
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	sv.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(buf)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("relayed connection still open after Close")
+	}
+}
+
+func TestSOCKSUDPAssociate(t *testing.T) {
+	// The UDP echo replies with the payload it got.
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	_, addr := newSOCKSServer(t,
+		targetOverride(t, "_echo._udp.marathon.mesos", echoAddr.String()))
+
+	_, rep, bound := socksRequest(t, addr, socksCmdUDPAssociate,
+		[]byte{socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	if rep != socksSucceeded {
+		t.Fatalf("got reply %d, want success", rep)
+	}
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The datagrams sent while the name is looked up are all delivered.
+	const datagrams = 5
+	header := append([]byte{0, 0, 0},
+		socksDomain("_echo._udp.marathon.mesos", 1)...)
+	for i := 0; i < datagrams; i++ {
+		packet := append(append([]byte(nil), header...),
+			fmt.Sprintf("ping %d", i)...)
+		if _, err := client.WriteToUDP(packet, relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantHeader := appendSOCKSAddr([]byte{0, 0, 0}, echoAddr)
+	got := make(map[string]bool)
+	buf := make([]byte, 1024)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(got) < datagrams {
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("got %d of %d replies: %s", len(got), datagrams, err)
+		}
+		if !bytes.HasPrefix(buf[:n], wantHeader) {
+			t.Fatalf("got reply %v, want it from %s", buf[:n], echoAddr)
+		}
+		got[string(buf[len(wantHeader):n])] = true
+	}
+	for i := 0; i < datagrams; i++ {
+		if !got[fmt.Sprintf("ping %d", i)] {
+			t.Errorf("no reply to ping %d", i)
+		}
+	}
+
+	// Datagrams from hosts the client didn't send to are dropped.
+	stranger, err := net.ListenUDP("udp",
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	stranger.WriteToUDP([]byte("spoofed"), relay)
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := client.ReadFromUDP(buf); err == nil {
+		t.Errorf("got %q from a host the client didn't send to", buf[:n])
+	} else if !strings.Contains(err.Error(), "timeout") {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// closeWriter is implemented by connections that can be half closed, like
+// *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies data between a and b in both directions until both sides
+// are done, then closes them. The end of the data from one side is passed
+// on as a half close when possible, so the other side can still respond. An
+// error in either direction, e.g., after a side was closed, ends both.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go pipe(a, b, &wg)
+	go pipe(b, a, &wg)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+func pipe(dst, src net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
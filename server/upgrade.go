@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dcos/octarine/srv"
+	"github.com/dcos/octarine/util"
+)
+
+// isUpgrade returns true if r asks to switch protocols, e.g., to
+// WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Method == http.MethodConnect || r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// srvName returns the SRV name r is for, if any. As for the goproxy
+// handlers, the DC/OS domain is only stripped in transparent mode.
+func srvName(r *http.Request, transparent bool) (string, bool) {
+	name := r.URL.Host
+	if name == "" {
+		name = r.Host
+	}
+	name = strings.Split(name, ":")[0]
+	if transparent {
+		name = strings.TrimSuffix(name, util.DcosDomain)
+	}
+	return name, strings.HasPrefix(name, "_")
+}
+
+// createUpgradeHandler returns a handler that passes the Upgrade requests
+// for SRV names through to the selected target, as goproxy can't relay
+// the stream that follows the switch. The client connection is hijacked,
+// the request is replayed to the target and the two are spliced. Hijacked
+// connections are tracked in conns. Every other request is served by next.
+func createUpgradeHandler(next http.Handler, cache srv.Cache, conns *connSet,
+	transparent bool) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, ok := srvName(r, transparent)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The protocol of the target is picked by the proxy, an h2c upgrade
+		// the listener didn't take is declined as the client allows.
+		if isH2CUpgrade(r) {
+			r.Header.Del("Upgrade")
+			r.Header.Del("Http2-Settings")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The body of an upgrade request is replayed from the hijacked
+		// connection, which only works if its length is known.
+		if r.ContentLength < 0 {
+			http.Error(w, "upgrade request with a chunked body",
+				http.StatusBadRequest)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "connection can't be upgraded",
+				http.StatusInternalServerError)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), dialTimeout)
+		defer cancel()
+		host, port, err := cache.Get(ctx, name)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		var d net.Dialer
+		upstream, err := d.DialContext(ctx, "tcp",
+			net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			log.Print("dial error: ", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			log.Print("hijack error: ", err)
+			upstream.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The server doesn't close hijacked connections.
+		if !conns.add(conn) {
+			upstream.Close()
+			return
+		}
+		defer conns.remove(conn)
+
+		if r.Host == "" {
+			r.Host = r.URL.Host
+		}
+		r.URL.Scheme, r.URL.Host = "", ""
+		r.Header.Del("Proxy-Connection")
+		// Keep Request.Write from adding its own User-Agent.
+		if _, ok := r.Header["User-Agent"]; !ok {
+			r.Header.Set("User-Agent", "")
+		}
+		// The server's body reader can't be used once the connection is
+		// hijacked, the body is still unread in rw.
+		r.Body = nil
+		if r.ContentLength > 0 {
+			r.Body = ioutil.NopCloser(io.LimitReader(rw, r.ContentLength))
+		}
+		if err := r.Write(upstream); err != nil {
+			log.Print("write error: ", err)
+			upstream.Close()
+			writeBadGateway(conn, err)
+			return
+		}
+		// Pass on whatever the client sent past the request.
+		if n := rw.Reader.Buffered(); n > 0 {
+			buffered, _ := rw.Reader.Peek(n)
+			if _, err := upstream.Write(buffered); err != nil {
+				upstream.Close()
+				conn.Close()
+				return
+			}
+		}
+		splice(conn, upstream)
+	})
+}
+
+// writeBadGateway answers the request read from the hijacked conn with a
+// 502 carrying err and closes conn.
+func writeBadGateway(conn net.Conn, err error) {
+	msg := err.Error() + "\n"
+	fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\nConnection: close\r\n\r\n%s", len(msg), msg)
+	conn.Close()
+}
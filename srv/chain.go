@@ -0,0 +1,139 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Backend is a resolver in a Chain.
+type Backend struct {
+	// Name identifies the backend in the cache entries.
+	Name     string
+	Resolver Resolver
+	// Timeout bounds each lookup of the backend, a zero Timeout leaves it to
+	// the backend.
+	Timeout time.Duration
+}
+
+// Chain is a resolver that asks its backends in order and returns the
+// answer of the first one that resolves the name. A backend that fails or
+// times out falls through to the next one, e.g., static overrides before
+// the resolvers of the cluster.
+//
+// The backend that answered is recorded in the cache entries.
+type Chain struct {
+	backends []Backend
+}
+
+// NewChain returns a resolver that tries backends in the given order.
+func NewChain(backends ...Backend) *Chain {
+	return &Chain{backends: backends}
+}
+
+// LookupSRV returns the answer of the first backend that resolves name.
+func (ch *Chain) LookupSRV(ctx context.Context, name string) (
+	addrs []*net.SRV, ttl time.Duration, err error) {
+
+	addrs, ttl, _, err = ch.lookupSRVSource(ctx, name)
+	return addrs, ttl, err
+}
+
+// lookupSRVSource is LookupSRV that also returns the name of the backend
+// that answered.
+//
+// If every backend fails, the errors are combined and the name is only
+// reported as not found if none of the backends found it.
+func (ch *Chain) lookupSRVSource(ctx context.Context, name string) (
+	addrs []*net.SRV, ttl time.Duration, source string, err error) {
+
+	if len(ch.backends) == 0 {
+		return nil, 0, "", fmt.Errorf("no resolver backends for %s", name)
+	}
+	var errs []string
+	notFound := true
+	for _, b := range ch.backends {
+		if ctx.Err() != nil {
+			return nil, 0, "", ctx.Err()
+		}
+		addrs, ttl, err = b.lookupSRV(ctx, name)
+		if err == nil {
+			return addrs, ttl, b.Name, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", b.Name, err))
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			notFound = false
+		}
+	}
+	if len(ch.backends) == 1 {
+		return nil, 0, "", err
+	}
+	return nil, 0, "", &net.DNSError{
+		Err:         strings.Join(errs, "; "),
+		Name:        name,
+		IsNotFound:  notFound,
+		IsTemporary: !notFound,
+	}
+}
+
+func (b Backend) lookupSRV(ctx context.Context, name string) (
+	[]*net.SRV, time.Duration, error) {
+
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+	return b.Resolver.LookupSRV(ctx, name)
+}
+
+// LookupIP returns the answer of the first backend that implements
+// HostResolver and resolves host, the system resolver is used if none of
+// them does.
+func (ch *Chain) LookupIP(ctx context.Context, host string) (
+	ips []net.IP, ttl time.Duration, err error) {
+
+	for _, b := range ch.backends {
+		hr, ok := b.Resolver.(HostResolver)
+		if !ok {
+			continue
+		}
+		lookupCtx := ctx
+		var cancel context.CancelFunc = func() {}
+		if b.Timeout > 0 {
+			lookupCtx, cancel = context.WithTimeout(ctx, b.Timeout)
+		}
+		ips, ttl, err = hr.LookupIP(lookupCtx, host)
+		cancel()
+		if err == nil {
+			return ips, ttl, nil
+		}
+	}
+	return SystemResolver().(HostResolver).LookupIP(ctx, host)
+}
+
+// Notify registers fn with every backend that implements Notifier.
+func (ch *Chain) Notify(fn func(name string)) {
+	for _, b := range ch.backends {
+		if n, ok := b.Resolver.(Notifier); ok {
+			n.Notify(fn)
+		}
+	}
+}
+
+// Close closes every backend that implements io.Closer and returns the
+// first error.
+func (ch *Chain) Close() error {
+	var err error
+	for _, b := range ch.backends {
+		if closer, ok := b.Resolver.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,384 @@
+package srv
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsPort       = "53"
+	dnsTypeA      = 1
+	dnsTypeAAAA   = 28
+	dnsTypeSRV    = 33
+	dnsClassINET  = 1
+	dnsHeaderLen  = 12
+	dnsMaxUDPSize = 512
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+)
+
+var errMalformed = errors.New("malformed DNS message")
+
+type dnsResolver struct {
+	servers []string
+	timeout time.Duration
+	rnd     *rand.Rand
+	rndLock *sync.Mutex
+}
+
+// NewDNSResolver returns a resolver that sends SRV queries directly to the
+// given DNS servers instead of going through the system resolver, e.g., to
+// the Mesos-DNS instance of a cluster.
+//
+// Servers are given as "ip" or "ip:port" and are tried in order, a server
+// that times out or fails to answer is skipped in favor of the next one.
+// Each query is bounded by timeout. Unlike the system resolver, the TTL of
+// the answer is reported.
+func NewDNSResolver(servers []string, timeout time.Duration) Resolver {
+	r := &dnsResolver{
+		timeout: timeout,
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		rndLock: &sync.Mutex{},
+	}
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, dnsPort)
+		}
+		r.servers = append(r.servers, s)
+	}
+	return r
+}
+
+func (r *dnsResolver) LookupSRV(ctx context.Context, name string) (
+	addrs []*net.SRV, ttl time.Duration, err error) {
+
+	msg, rrs, err := r.lookup(ctx, name, dnsTypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var minTTL uint32
+	for _, rr := range rrs {
+		if rr.typ != dnsTypeSRV {
+			continue
+		}
+		if rr.length < 7 {
+			return nil, 0, &net.DNSError{Err: errMalformed.Error(), Name: name,
+				IsTemporary: true}
+		}
+		target, _, err := readName(msg, rr.off+6)
+		if err != nil {
+			return nil, 0, &net.DNSError{Err: errMalformed.Error(), Name: name,
+				IsTemporary: true}
+		}
+		addrs = append(addrs, &net.SRV{
+			Priority: binary.BigEndian.Uint16(msg[rr.off:]),
+			Weight:   binary.BigEndian.Uint16(msg[rr.off+2:]),
+			Port:     binary.BigEndian.Uint16(msg[rr.off+4:]),
+			Target:   target,
+		})
+		if len(addrs) == 1 || rr.ttl < minTTL {
+			minTTL = rr.ttl
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name,
+			IsNotFound: true}
+	}
+	return addrs, time.Duration(minTTL) * time.Second, nil
+}
+
+// LookupIP queries both the A and AAAA records of host, the returned TTL
+// is the lowest TTL among them.
+func (r *dnsResolver) LookupIP(ctx context.Context, host string) (
+	ips []net.IP, ttl time.Duration, err error) {
+
+	var minTTL uint32
+	var lastErr error
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		msg, rrs, err := r.lookup(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range rrs {
+			var ip net.IP
+			switch {
+			case rr.typ == dnsTypeA && rr.length == net.IPv4len:
+				ip = net.IP(msg[rr.off : rr.off+net.IPv4len])
+			case rr.typ == dnsTypeAAAA && rr.length == net.IPv6len:
+				ip = net.IP(msg[rr.off : rr.off+net.IPv6len])
+			default:
+				continue
+			}
+			ips = append(ips, append(net.IP(nil), ip...))
+			if len(ips) == 1 || rr.ttl < minTTL {
+				minTTL = rr.ttl
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr != nil {
+			return nil, 0, lastErr
+		}
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host,
+			IsNotFound: true}
+	}
+	return ips, time.Duration(minTTL) * time.Second, nil
+}
+
+// lookup sends a query of type qtype for name to the servers in order and
+// returns the first answer along with its resource records.
+func (r *dnsResolver) lookup(ctx context.Context, name string, qtype uint16) (
+	msg []byte, rrs []dnsRR, err error) {
+
+	if len(r.servers) == 0 {
+		return nil, nil, fmt.Errorf("no DNS servers configured for %s", name)
+	}
+	for _, server := range r.servers {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		msg, rrs, err = r.exchange(ctx, server, name, qtype)
+		if err == nil {
+			return msg, rrs, nil
+		}
+		// A missing name is an authoritative answer, asking another server
+		// won't change it.
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, err
+}
+
+func (r *dnsResolver) newID() uint16 {
+	r.rndLock.Lock()
+	defer r.rndLock.Unlock()
+	return uint16(r.rnd.Intn(1 << 16))
+}
+
+// exchange sends a query for name to server over UDP and retries over TCP
+// if the answer was truncated.
+func (r *dnsResolver) exchange(ctx context.Context, server, name string,
+	qtype uint16) (msg []byte, rrs []dnsRR, err error) {
+
+	id := r.newID()
+	query, err := newQuery(id, name, qtype)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg, err = r.roundTrip(ctx, "udp", server, query)
+	if err == nil && msg[2]&0x02 != 0 {
+		msg, err = r.roundTrip(ctx, "tcp", server, query)
+	}
+	if err != nil {
+		return nil, nil, &net.DNSError{
+			Err:         err.Error(),
+			Name:        name,
+			Server:      server,
+			IsTimeout:   isTimeout(err),
+			IsTemporary: true,
+		}
+	}
+	rrs, err = parseResponse(id, name, server, msg)
+	return msg, rrs, err
+}
+
+func (r *dnsResolver) roundTrip(ctx context.Context, network, server string,
+	query []byte) ([]byte, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	// Unblock reads and writes if ctx is cancelled before the deadline.
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now())
+	}()
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dnsMaxUDPSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < dnsHeaderLen {
+			return nil, errMalformed
+		}
+		return buf[:n], nil
+	}
+
+	// Messages over TCP are prefixed with their length.
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if len(buf) < dnsHeaderLen {
+		return nil, errMalformed
+	}
+	return buf, nil
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// newQuery builds a recursive query for the records of type qtype of name.
+func newQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLen, dnsHeaderLen+len(name)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	// Recursion desired
+	binary.BigEndian.PutUint16(msg[2:], 0x0100)
+	// One question
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassINET)
+	return msg, nil
+}
+
+// dnsRR is a resource record of the answer section, its data is the
+// length bytes of the message starting at off.
+type dnsRR struct {
+	typ    uint16
+	ttl    uint32
+	off    int
+	length int
+}
+
+// parseResponse checks the header of msg and returns the records of its
+// answer section.
+func parseResponse(id uint16, name, server string, msg []byte) (
+	[]dnsRR, error) {
+
+	if binary.BigEndian.Uint16(msg[0:]) != id || msg[2]&0x80 == 0 {
+		return nil, &net.DNSError{Err: "unexpected DNS response",
+			Name: name, Server: server, IsTemporary: true}
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case dnsRcodeSuccess:
+	case dnsRcodeNXDomain:
+		return nil, &net.DNSError{Err: "no such host", Name: name,
+			Server: server, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{
+			Err: fmt.Sprintf("server failure (rcode %d)", rcode), Name: name,
+			Server: server, IsTemporary: true}
+	}
+
+	malformed := &net.DNSError{Err: errMalformed.Error(), Name: name,
+		Server: server, IsTemporary: true}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := dnsHeaderLen
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if _, off, err = readName(msg, off); err != nil {
+			return nil, malformed
+		}
+		off += 4
+	}
+
+	rrs := make([]dnsRR, 0, ancount)
+	for i := 0; i < ancount; i++ {
+		if _, off, err = readName(msg, off); err != nil {
+			return nil, malformed
+		}
+		if off+10 > len(msg) {
+			return nil, malformed
+		}
+		rr := dnsRR{
+			typ:    binary.BigEndian.Uint16(msg[off:]),
+			ttl:    binary.BigEndian.Uint32(msg[off+4:]),
+			length: int(binary.BigEndian.Uint16(msg[off+8:])),
+			off:    off + 10,
+		}
+		if rr.off+rr.length > len(msg) {
+			return nil, malformed
+		}
+		rrs = append(rrs, rr)
+		off = rr.off + rr.length
+	}
+	return rrs, nil
+}
+
+// readName decodes the, possibly compressed, domain name at off and returns
+// it in absolute form along with the offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		n := int(msg[off])
+		switch n & 0xc0 {
+		case 0x00:
+			if n == 0 {
+				if next == -1 {
+					next = off + 1
+				}
+				return strings.Join(labels, ".") + ".", next, nil
+			}
+			if off+1+n > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		case 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errMalformed
+			}
+			if next == -1 {
+				next = off + 2
+			}
+			// Guard against pointer loops.
+			if jumps++; jumps > 10 {
+				return "", 0, errMalformed
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			return "", 0, errMalformed
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package srv
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubDNS is a DNS server on the same UDP and TCP port of the loopback
+// interface, answering queries with handle. A nil answer is dropped.
+type stubDNS struct {
+	addr    string
+	udp     net.PacketConn
+	tcp     net.Listener
+	handle  func(query []byte, tcp bool) []byte
+	queries int32
+}
+
+func newStubDNS(t *testing.T, handle func(query []byte, tcp bool) []byte) *stubDNS {
+	t.Helper()
+	s := &stubDNS{handle: handle}
+	for i := 0; ; i++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err == nil {
+			s.udp, s.tcp, s.addr = udp, tcp, udp.LocalAddr().String()
+			break
+		}
+		udp.Close()
+		if i == 10 {
+			t.Fatal(err)
+		}
+	}
+	go s.serveUDP()
+	go s.serveTCP()
+	t.Cleanup(func() {
+		s.udp.Close()
+		s.tcp.Close()
+	})
+	return s
+}
+
+func (s *stubDNS) serveUDP() {
+	buf := make([]byte, dnsMaxUDPSize)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.queries, 1)
+		if resp := s.handle(append([]byte(nil), buf[:n]...), false); resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *stubDNS) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			atomic.AddInt32(&s.queries, 1)
+			resp := s.handle(query, true)
+			if resp == nil {
+				return
+			}
+			binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+			conn.Write(append(length[:], resp...))
+		}()
+	}
+}
+
+func (s *stubDNS) count() int {
+	return int(atomic.LoadInt32(&s.queries))
+}
+
+// respond builds the response to query with the given rcode and answer
+// records, the question is copied from the query.
+func respond(query []byte, rcode byte, truncated bool, rrs ...[]byte) []byte {
+	resp := append([]byte(nil), query...)
+	resp[2] = 0x81 // QR, RD
+	if truncated {
+		resp[2] |= 0x02
+	}
+	resp[3] = 0x80 | rcode // RA
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(rrs)))
+	for _, rr := range rrs {
+		resp = append(resp, rr...)
+	}
+	return resp
+}
+
+// questionName is a pointer to the name of the question, which always
+// starts right after the header.
+var questionName = []byte{0xc0, dnsHeaderLen}
+
+// marathonMesos is a pointer to "marathon.mesos." within the question
+// "_app._tcp.marathon.mesos.", after "\x04_app\x04_tcp".
+var marathonMesos = []byte{0xc0, dnsHeaderLen + 10}
+
+func srvRR(owner []byte, ttl uint32, priority, weight, port uint16,
+	target []byte) []byte {
+
+	rdata := make([]byte, 6, 6+len(target))
+	binary.BigEndian.PutUint16(rdata[0:], priority)
+	binary.BigEndian.PutUint16(rdata[2:], weight)
+	binary.BigEndian.PutUint16(rdata[4:], port)
+	rdata = append(rdata, target...)
+	return rr(owner, dnsTypeSRV, ttl, rdata)
+}
+
+func rr(owner []byte, typ uint16, ttl uint32, rdata []byte) []byte {
+	b := append([]byte(nil), owner...)
+	var fixed [10]byte
+	binary.BigEndian.PutUint16(fixed[0:], typ)
+	binary.BigEndian.PutUint16(fixed[2:], dnsClassINET)
+	binary.BigEndian.PutUint32(fixed[4:], ttl)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(rdata)))
+	b = append(b, fixed[:]...)
+	return append(b, rdata...)
+}
+
+// label encodes the labels followed by rest, either a pointer or the root.
+func label(rest []byte, labels ...string) []byte {
+	var b []byte
+	for _, l := range labels {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, rest...)
+}
+
+const testName = "_app._tcp.marathon.mesos"
+
+func TestDNSResolverCompression(t *testing.T) {
+	s := newStubDNS(t, func(query []byte, tcp bool) []byte {
+		return respond(query, dnsRcodeSuccess, false,
+			srvRR(questionName, 30, 0, 10, 8080, label(marathonMesos, "a")),
+			srvRR(questionName, 20, 1, 5, 8081,
+				label([]byte{0}, "b", "example", "com")))
+	})
+	r := NewDNSResolver([]string{s.addr}, time.Second)
+
+	addrs, ttl, err := r.LookupSRV(context.Background(), testName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []net.SRV{
+		{Target: "a.marathon.mesos.", Port: 8080, Priority: 0, Weight: 10},
+		{Target: "b.example.com.", Port: 8081, Priority: 1, Weight: 5},
+	}
+	if len(addrs) != len(want) {
+		t.Fatalf("got %d records, want %d", len(addrs), len(want))
+	}
+	for i, addr := range addrs {
+		if *addr != want[i] {
+			t.Errorf("record %d: got %+v, want %+v", i, *addr, want[i])
+		}
+	}
+	if ttl != 20*time.Second {
+		t.Errorf("got TTL %s, want the lowest TTL 20s", ttl)
+	}
+}
+
+func TestDNSResolverTruncation(t *testing.T) {
+	var overTCP int32
+	s := newStubDNS(t, func(query []byte, tcp bool) []byte {
+		if !tcp {
+			return respond(query, dnsRcodeSuccess, true)
+		}
+		atomic.AddInt32(&overTCP, 1)
+		return respond(query, dnsRcodeSuccess, false,
+			srvRR(questionName, 30, 0, 1, 80, label(marathonMesos, "tcp")))
+	})
+	r := NewDNSResolver([]string{s.addr}, time.Second)
+
+	addrs, _, err := r.LookupSRV(context.Background(), testName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&overTCP) != 1 {
+		t.Fatal("truncated answer was not retried over TCP")
+	}
+	if len(addrs) != 1 || addrs[0].Target != "tcp.marathon.mesos." {
+		t.Errorf("got %v, want the answer sent over TCP", addrs)
+	}
+}
+
+func TestDNSResolverNotFound(t *testing.T) {
+	tests := []struct {
+		name  string
+		rcode byte
+	}{
+		{"NXDOMAIN", dnsRcodeNXDomain},
+		{"NODATA", dnsRcodeSuccess},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s1 := newStubDNS(t, func(query []byte, tcp bool) []byte {
+				return respond(query, test.rcode, false)
+			})
+			s2 := newStubDNS(t, func(query []byte, tcp bool) []byte {
+				return respond(query, dnsRcodeSuccess, false,
+					srvRR(questionName, 30, 0, 1, 80, label(marathonMesos, "a")))
+			})
+			r := NewDNSResolver([]string{s1.addr, s2.addr}, time.Second)
+
+			_, _, err := r.LookupSRV(context.Background(), testName)
+			dnsErr, ok := err.(*net.DNSError)
+			if !ok || !dnsErr.IsNotFound {
+				t.Fatalf("got %v, want a not found error", err)
+			}
+			if s2.count() != 0 {
+				t.Error("authoritative answer was followed by a failover")
+			}
+		})
+	}
+}
+
+func TestDNSResolverMalformed(t *testing.T) {
+	s := newStubDNS(t, func(query []byte, tcp bool) []byte {
+		resp := respond(query, dnsRcodeSuccess, false,
+			srvRR(questionName, 30, 0, 1, 80, label(marathonMesos, "a")))
+		// Cut the answer short of its data.
+		return resp[:len(resp)-4]
+	})
+	r := NewDNSResolver([]string{s.addr}, time.Second)
+
+	_, _, err := r.LookupSRV(context.Background(), testName)
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok || dnsErr.IsNotFound || !dnsErr.IsTemporary {
+		t.Fatalf("got %v, want a temporary error", err)
+	}
+}
+
+func TestDNSResolverFailover(t *testing.T) {
+	answer := func(query []byte, tcp bool) []byte {
+		return respond(query, dnsRcodeSuccess, false,
+			srvRR(questionName, 30, 0, 1, 80, label(marathonMesos, "ok")))
+	}
+	tests := []struct {
+		name   string
+		handle func(query []byte, tcp bool) []byte
+	}{
+		{"timeout", func(query []byte, tcp bool) []byte { return nil }},
+		{"server failure", func(query []byte, tcp bool) []byte {
+			return respond(query, 2, false)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s1 := newStubDNS(t, test.handle)
+			s2 := newStubDNS(t, answer)
+			r := NewDNSResolver([]string{s1.addr, s2.addr},
+				100*time.Millisecond)
+
+			addrs, _, err := r.LookupSRV(context.Background(), testName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s1.count() != 1 {
+				t.Errorf("first server got %d queries, want 1", s1.count())
+			}
+			if len(addrs) != 1 || addrs[0].Target != "ok.marathon.mesos." {
+				t.Errorf("got %v, want the answer of the second server", addrs)
+			}
+		})
+	}
+}
+
+func TestDNSResolverLookupIP(t *testing.T) {
+	s := newStubDNS(t, func(query []byte, tcp bool) []byte {
+		switch binary.BigEndian.Uint16(query[len(query)-4:]) {
+		case dnsTypeA:
+			return respond(query, dnsRcodeSuccess, false,
+				rr(questionName, dnsTypeA, 60, []byte{10, 0, 0, 1}))
+		case dnsTypeAAAA:
+			return respond(query, dnsRcodeSuccess, false,
+				rr(questionName, dnsTypeAAAA, 30, net.ParseIP("fd00::1")))
+		}
+		return respond(query, dnsRcodeNXDomain, false)
+	})
+	r := NewDNSResolver([]string{s.addr}, time.Second).(*dnsResolver)
+
+	ips, ttl, err := r.LookupIP(context.Background(), "a.marathon.mesos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) ||
+		!ips[1].Equal(net.ParseIP("fd00::1")) {
+
+		t.Errorf("got %v, want 10.0.0.1 and fd00::1", ips)
+	}
+	if ttl != 30*time.Second {
+		t.Errorf("got TTL %s, want the lowest TTL 30s", ttl)
+	}
+}
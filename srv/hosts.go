@@ -0,0 +1,133 @@
+package srv
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// address returns the host and port to connect to for the SRV record t:
+// with Config.ResolveTargets, the host is an IP address of the target,
+// otherwise or if its addresses can't be looked up it's the target name.
+func (c *cache) address(ctx context.Context, t *net.SRV) (
+	host string, port uint16, err error) {
+
+	if !c.config.ResolveTargets || net.ParseIP(t.Target) != nil {
+		return t.Target, t.Port, nil
+	}
+	ip, err := c.getIP(ctx, t.Target)
+	if err != nil {
+		if ctx.Err() != nil || err == ErrClosed {
+			return "", 0, err
+		}
+		// Leave it to the dialer to resolve the name.
+		return t.Target, t.Port, nil
+	}
+	return ip.String(), t.Port, nil
+}
+
+// getIP returns one of the cached addresses of host, looking them up if
+// needed.
+func (c *cache) getIP(ctx context.Context, host string) (net.IP, error) {
+	c.recordLock.Lock()
+	v, ok := c.hosts.get(host)
+	if ok && !v.expired() {
+		defer c.recordLock.Unlock()
+		if v.err != nil {
+			return nil, v.err
+		}
+		return v.ips[c.rnd.Intn(len(v.ips))], nil
+	}
+	if ok && c.servable(v) {
+		defer c.recordLock.Unlock()
+		if _, inFlight := c.hostCalls[host]; !inFlight &&
+			time.Now().After(v.retry) {
+
+			c.lookupHost(host)
+		}
+		return v.ips[c.rnd.Intn(len(v.ips))], nil
+	}
+	cl := c.lookupHost(host)
+	c.recordLock.Unlock()
+
+	select {
+	case <-cl.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, ErrClosed
+	}
+	if cl.err != nil {
+		return nil, cl.err
+	}
+	c.recordLock.Lock()
+	defer c.recordLock.Unlock()
+	return cl.ips[c.rnd.Intn(len(cl.ips))], nil
+}
+
+// prefetchHosts starts address lookups for the targets of addrs that are
+// not cached, so the first Get rarely has to wait for them. recordLock must
+// be held.
+func (c *cache) prefetchHosts(addrs []*net.SRV) {
+	for _, addr := range addrs {
+		if net.ParseIP(addr.Target) != nil {
+			continue
+		}
+		if v, ok := c.hosts.peek(addr.Target); ok && !v.expired() {
+			continue
+		}
+		if _, inFlight := c.hostCalls[addr.Target]; !inFlight {
+			c.lookupHost(addr.Target)
+		}
+	}
+}
+
+// lookupHost returns the address lookup in flight for host, starting one if
+// there is none, recordLock must be held.
+func (c *cache) lookupHost(host string) *call {
+	if cl, ok := c.hostCalls[host]; ok {
+		c.stats.Coalesced++
+		return cl
+	}
+	cl := &call{done: make(chan struct{})}
+	c.hostCalls[host] = cl
+	c.stats.HostLookups++
+	go c.resolveHost(host, cl)
+	return cl
+}
+
+// resolveHost queries the addresses of host and stores the result in both
+// the cache and cl.
+func (c *cache) resolveHost(host string, cl *call) {
+	hr, ok := c.config.Resolver.(HostResolver)
+	if !ok {
+		hr = systemResolver{}
+	}
+	ips, ttl, err := hr.LookupIP(c.ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	c.recordLock.Lock()
+	defer c.recordLock.Unlock()
+	delete(c.hostCalls, host)
+	if err != nil {
+		cl.err = newLookupError(host, err)
+		if old, ok := c.hosts.peek(host); ok && old.ips != nil &&
+			c.servable(old) {
+
+			old.retry = time.Now().Add(c.config.NegativeTTL)
+			c.stats.Evictions += uint64(c.hosts.set(host, old))
+		} else if c.config.NegativeTTL > 0 {
+			c.stats.Evictions += uint64(c.hosts.set(host,
+				newNegativeEntry(cl.err, c.config.NegativeTTL)))
+		}
+	} else {
+		cl.ips = ips
+		c.stats.Evictions += uint64(c.hosts.set(host, entry{
+			ips:    ips,
+			expire: time.Now().Add(c.ttl(ttl)),
+		}))
+	}
+	close(cl.done)
+}
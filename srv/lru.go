@@ -0,0 +1,90 @@
+package srv
+
+import (
+	"container/list"
+)
+
+// lru stores the cache entries and evicts the least recently used one when
+// adding an entry would exceed max, a max of 0 means there is no limit.
+//
+// It is not safe for concurrent use.
+type lru struct {
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	name  string
+	entry entry
+}
+
+func newLRU(max int) *lru {
+	return &lru{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the entry of name and marks it as the most recently used.
+func (l *lru) get(name string) (entry, bool) {
+	el, ok := l.items[name]
+	if !ok {
+		return entry{}, false
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*lruItem).entry, true
+}
+
+// peek returns the entry of name without affecting its recency.
+func (l *lru) peek(name string) (entry, bool) {
+	el, ok := l.items[name]
+	if !ok {
+		return entry{}, false
+	}
+	return el.Value.(*lruItem).entry, true
+}
+
+// set stores the entry of name as the most recently used one and returns
+// the number of entries evicted to make room for it.
+func (l *lru) set(name string, e entry) (evicted int) {
+	if el, ok := l.items[name]; ok {
+		el.Value.(*lruItem).entry = e
+		l.ll.MoveToFront(el)
+		return 0
+	}
+	l.items[name] = l.ll.PushFront(&lruItem{name: name, entry: e})
+	for l.max > 0 && l.ll.Len() > l.max {
+		l.removeElement(l.ll.Back())
+		evicted++
+	}
+	return evicted
+}
+
+func (l *lru) remove(name string) {
+	if el, ok := l.items[name]; ok {
+		l.removeElement(el)
+	}
+}
+
+func (l *lru) removeElement(el *list.Element) {
+	l.ll.Remove(el)
+	delete(l.items, el.Value.(*lruItem).name)
+}
+
+// removeIf removes all entries for which fn returns true.
+func (l *lru) removeIf(fn func(name string, e entry) bool) {
+	for el := l.ll.Front(); el != nil; {
+		next := el.Next()
+		item := el.Value.(*lruItem)
+		if fn(item.name, item.entry) {
+			l.removeElement(el)
+		}
+		el = next
+	}
+}
+
+func (l *lru) len() int {
+	return l.ll.Len()
+}
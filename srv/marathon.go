@@ -0,0 +1,334 @@
+package srv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MarathonDomain is the domain of the names served by the Marathon
+// resolver, matching the names Mesos-DNS gives to Marathon apps.
+const MarathonDomain = "marathon.mesos"
+
+// defaultMarathonInterval is how often the apps are polled when no
+// positive interval is given.
+const defaultMarathonInterval = 30 * time.Second
+
+// marathonEvents are the Marathon event types that can change the healthy
+// tasks of an app.
+var marathonEvents = map[string]bool{
+	"status_update_event":           true,
+	"health_status_changed_event":   true,
+	"instance_health_changed_event": true,
+	"app_terminated_event":          true,
+	"deployment_success":            true,
+	"deployment_failed":             true,
+}
+
+type marathonApps struct {
+	Apps []marathonApp `json:"apps"`
+}
+
+type marathonApp struct {
+	ID              string                   `json:"id"`
+	HealthChecks    []json.RawMessage        `json:"healthChecks"`
+	PortDefinitions []marathonPortDefinition `json:"portDefinitions"`
+	Tasks           []marathonTask           `json:"tasks"`
+}
+
+type marathonPortDefinition struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+}
+
+type marathonTask struct {
+	Host               string                 `json:"host"`
+	Ports              []uint16               `json:"ports"`
+	State              string                 `json:"state"`
+	HealthCheckResults []marathonHealthResult `json:"healthCheckResults"`
+}
+
+type marathonHealthResult struct {
+	Alive bool `json:"alive"`
+}
+
+// MarathonResolver resolves the names of Marathon apps to their healthy
+// tasks, it keeps a table of the apps that is refreshed every interval and
+// whenever the Marathon event stream reports a change to a task.
+//
+// Names follow the Mesos-DNS scheme: the app "/group/app" is
+// "_app-group._tcp.marathon.mesos" and its port named "http" is
+// "_http._app-group._tcp.marathon.mesos".
+type MarathonResolver struct {
+	baseURL  string
+	client   *http.Client
+	interval time.Duration
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	refresh chan struct{}
+
+	table     map[string][]*net.SRV
+	tableErr  error
+	notify    []func(name string)
+	tableLock *sync.Mutex
+}
+
+// NewMarathonResolver returns a resolver for the apps of the Marathon at
+// baseURL, e.g., "http://marathon.mesos:8080". The app table is polled
+// every interval and, if events is true, refreshed as soon as /v2/events
+// reports a change. A non-positive interval is replaced by 30 seconds.
+//
+// The resolver works in the background until it's closed. If client is
+// nil, http.DefaultClient is used for polling, the event stream never
+// times out.
+func NewMarathonResolver(baseURL string, client *http.Client,
+	interval time.Duration, events bool) *MarathonResolver {
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if interval <= 0 {
+		interval = defaultMarathonInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &MarathonResolver{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		client:    client,
+		interval:  interval,
+		ctx:       ctx,
+		cancel:    cancel,
+		refresh:   make(chan struct{}, 1),
+		tableErr:  fmt.Errorf("Marathon apps at %s not loaded yet", baseURL),
+		tableLock: &sync.Mutex{},
+	}
+	go r.startPolling()
+	if events {
+		go r.startEvents()
+	}
+	return r
+}
+
+// LookupSRV returns the healthy tasks of the app named name.
+//
+// Changes are pushed through Notify, so the TTL is reported as unknown.
+func (r *MarathonResolver) LookupSRV(ctx context.Context, name string) (
+	addrs []*net.SRV, ttl time.Duration, err error) {
+
+	r.tableLock.Lock()
+	defer r.tableLock.Unlock()
+	if r.table == nil {
+		return nil, 0, &net.DNSError{Err: r.tableErr.Error(), Name: name,
+			Server: r.baseURL, IsTemporary: true}
+	}
+	addrs, ok := r.table[normalizeName(name)]
+	if !ok || len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name,
+			Server: r.baseURL, IsNotFound: true}
+	}
+	return addrs, 0, nil
+}
+
+// Notify registers fn to be called with every name whose healthy tasks
+// change.
+func (r *MarathonResolver) Notify(fn func(name string)) {
+	r.tableLock.Lock()
+	defer r.tableLock.Unlock()
+	r.notify = append(r.notify, fn)
+}
+
+// Close stops polling Marathon and following its events.
+func (r *MarathonResolver) Close() error {
+	r.cancel()
+	return nil
+}
+
+func (r *MarathonResolver) startPolling() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.update(); err != nil {
+			log.Print("error updating Marathon apps: ", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-r.refresh:
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// update fetches the apps from Marathon and replaces the table.
+func (r *MarathonResolver) update() error {
+	req, err := http.NewRequest("GET", r.baseURL+"/v2/apps?embed=apps.tasks",
+		nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := r.client.Do(req.WithContext(r.ctx))
+	if err != nil {
+		r.setTableErr(err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected Marathon response: %s", resp.Status)
+		r.setTableErr(err)
+		return err
+	}
+	var apps marathonApps
+	if err := json.NewDecoder(resp.Body).Decode(&apps); err != nil {
+		r.setTableErr(err)
+		return err
+	}
+	r.setTable(newMarathonTable(apps))
+	return nil
+}
+
+func (r *MarathonResolver) setTableErr(err error) {
+	r.tableLock.Lock()
+	defer r.tableLock.Unlock()
+	r.tableErr = err
+}
+
+// setTable replaces the table and notifies about the names that changed.
+func (r *MarathonResolver) setTable(table map[string][]*net.SRV) {
+	r.tableLock.Lock()
+	old := r.table
+	r.table = table
+	notify := r.notify
+	r.tableLock.Unlock()
+
+	if old != nil {
+		notifyChanges(old, table, notify)
+	}
+}
+
+// startEvents follows the Marathon event stream and triggers a refresh of
+// the table on events that concern tasks, reconnecting when the stream
+// breaks.
+func (r *MarathonResolver) startEvents() {
+	for {
+		if err := r.followEvents(); err != nil {
+			log.Print("error following Marathon events: ", err)
+		}
+		select {
+		case <-time.After(r.interval):
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *MarathonResolver) followEvents() error {
+	req, err := http.NewRequest("GET", r.baseURL+"/v2/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	// The stream is long lived, only the transport of the polling client is
+	// reused.
+	client := &http.Client{Transport: r.client.Transport}
+	resp, err := client.Do(req.WithContext(r.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected Marathon response: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "event:") {
+			continue
+		}
+		if marathonEvents[strings.TrimSpace(strings.TrimPrefix(line, "event:"))] {
+			select {
+			case r.refresh <- struct{}{}:
+			default:
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && r.ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// newMarathonTable maps the Mesos-DNS style names of apps to the SRV
+// records of their healthy tasks.
+func newMarathonTable(apps marathonApps) map[string][]*net.SRV {
+	table := make(map[string][]*net.SRV)
+	for _, app := range apps.Apps {
+		label := marathonLabel(app.ID)
+		if label == "" {
+			continue
+		}
+		for _, task := range app.Tasks {
+			if !task.healthy(len(app.HealthChecks)) {
+				continue
+			}
+			for i, port := range task.Ports {
+				proto := "tcp"
+				var portName string
+				if i < len(app.PortDefinitions) {
+					portName = app.PortDefinitions[i].Name
+					if p := app.PortDefinitions[i].Protocol; p == "udp" {
+						proto = p
+					}
+				}
+				addr := &net.SRV{Target: task.Host, Port: port, Weight: 1}
+				name := fmt.Sprintf("_%s._%s.%s", label, proto, MarathonDomain)
+				table[name] = append(table[name], addr)
+				if portName != "" {
+					name = fmt.Sprintf("_%s._%s._%s.%s", portName, label, proto,
+						MarathonDomain)
+					table[name] = append(table[name], addr)
+				}
+			}
+		}
+	}
+	return table
+}
+
+func (t marathonTask) healthy(checks int) bool {
+	if t.State != "" && t.State != "TASK_RUNNING" {
+		return false
+	}
+	if len(t.HealthCheckResults) < checks {
+		return false
+	}
+	for _, result := range t.HealthCheckResults {
+		if !result.Alive {
+			return false
+		}
+	}
+	return true
+}
+
+// marathonLabel returns the Mesos-DNS label of an app ID, the path
+// components of the ID in reverse order joined by dashes.
+func marathonLabel(id string) string {
+	parts := strings.Split(strings.Trim(id, "/"), "/")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return strings.ToLower(strings.Join(parts, "-"))
+}
+
+// normalizeName returns name in lower case and without a trailing dot.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
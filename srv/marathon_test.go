@@ -0,0 +1,219 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMarathonLabel(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"/app", "app"},
+		{"app", "app"},
+		{"/group/app", "app-group"},
+		{"/a/b/c/", "c-b-a"},
+		{"/Group/App", "app-group"},
+		{"/", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := marathonLabel(test.id); got != test.want {
+			t.Errorf("marathonLabel(%q) = %q, want %q", test.id, got,
+				test.want)
+		}
+	}
+}
+
+func TestMarathonTaskHealthy(t *testing.T) {
+	alive := marathonHealthResult{Alive: true}
+	dead := marathonHealthResult{Alive: false}
+	tests := []struct {
+		name   string
+		task   marathonTask
+		checks int
+		want   bool
+	}{
+		{"no state and no checks", marathonTask{}, 0, true},
+		{"running", marathonTask{State: "TASK_RUNNING"}, 0, true},
+		{"staging", marathonTask{State: "TASK_STAGING"}, 0, false},
+		{"killed", marathonTask{State: "TASK_KILLED"}, 0, false},
+		{"check passed", marathonTask{
+			HealthCheckResults: []marathonHealthResult{alive}}, 1, true},
+		{"check failed", marathonTask{
+			HealthCheckResults: []marathonHealthResult{alive, dead}}, 2, false},
+		{"check pending", marathonTask{
+			HealthCheckResults: []marathonHealthResult{alive}}, 2, false},
+	}
+	for _, test := range tests {
+		if got := test.task.healthy(test.checks); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+// marathonAppsJSON are apps as returned by /v2/apps?embed=apps.tasks.
+const marathonAppsJSON = `{"apps": [
+	{
+		"id": "/group/web",
+		"healthChecks": [{"protocol": "HTTP"}],
+		"portDefinitions": [
+			{"name": "http", "protocol": "tcp"},
+			{"name": "", "protocol": "udp"}
+		],
+		"tasks": [
+			{"host": "a.mesos", "ports": [31000, 31001],
+			 "state": "TASK_RUNNING",
+			 "healthCheckResults": [{"alive": true}]},
+			{"host": "b.mesos", "ports": [31002, 31003],
+			 "state": "TASK_RUNNING",
+			 "healthCheckResults": [{"alive": false}]},
+			{"host": "c.mesos", "ports": [31004, 31005],
+			 "state": "TASK_RUNNING"}
+		]
+	},
+	{
+		"id": "/db",
+		"tasks": [
+			{"host": "d.mesos", "ports": [32000, 32001]},
+			{"host": "e.mesos", "ports": [32002], "state": "TASK_STAGING"}
+		]
+	},
+	{"id": "/", "tasks": [{"host": "f.mesos", "ports": [33000]}]}
+]}`
+
+func TestNewMarathonTable(t *testing.T) {
+	var apps marathonApps
+	if err := json.Unmarshal([]byte(marathonAppsJSON), &apps); err != nil {
+		t.Fatal(err)
+	}
+	record := func(target string, port uint16) *net.SRV {
+		return &net.SRV{Target: target, Port: port, Weight: 1}
+	}
+	want := map[string][]*net.SRV{
+		"_web-group._tcp.marathon.mesos":       {record("a.mesos", 31000)},
+		"_http._web-group._tcp.marathon.mesos": {record("a.mesos", 31000)},
+		"_web-group._udp.marathon.mesos":       {record("a.mesos", 31001)},
+		"_db._tcp.marathon.mesos": {record("d.mesos", 32000),
+			record("d.mesos", 32001)},
+	}
+	if got := newMarathonTable(apps); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// marathonStub serves apps on /v2/apps and sends a task event on
+// /v2/events for every value sent to events.
+type marathonStub struct {
+	*httptest.Server
+	lock   sync.Mutex
+	apps   string
+	events chan string
+}
+
+func newMarathonStub(t *testing.T, apps string) *marathonStub {
+	t.Helper()
+	s := &marathonStub{apps: apps, events: make(chan string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v2/apps":
+				s.lock.Lock()
+				defer s.lock.Unlock()
+				fmt.Fprint(w, s.apps)
+			case "/v2/events":
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.(http.Flusher).Flush()
+				for {
+					select {
+					case event := <-s.events:
+						fmt.Fprintf(w, "event: %s\ndata: {}\n\n", event)
+						w.(http.Flusher).Flush()
+					case <-r.Context().Done():
+						return
+					}
+				}
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *marathonStub) setApps(apps string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.apps = apps
+}
+
+// TestMarathonResolver checks the names of the healthy tasks resolve and
+// that a task event refreshes the table and notifies about the changes.
+func TestMarathonResolver(t *testing.T) {
+	s := newMarathonStub(t, marathonAppsJSON)
+	r := NewMarathonResolver(s.URL+"/", nil, time.Hour, true)
+	defer r.Close()
+	changed := make(chan string, 10)
+	r.Notify(func(name string) { changed <- name })
+
+	lookup := func(name string) ([]*net.SRV, error) {
+		addrs, _, err := r.LookupSRV(context.Background(), name)
+		return addrs, err
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := lookup("_db._tcp.marathon.mesos")
+		if err == nil {
+			break
+		}
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsTemporary {
+			t.Fatalf("before loading: got %v, want a temporary error", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("apps not loaded: ", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	addrs, err := lookup("_HTTP._web-group._tcp.marathon.mesos.")
+	if err != nil || len(addrs) != 1 || addrs[0].Target != "a.mesos" {
+		t.Errorf("named port: got %v, %v, want a.mesos", addrs, err)
+	}
+	_, err = lookup("_gone._tcp.marathon.mesos")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Errorf("unknown app: got %v, want a not found error", err)
+	}
+
+	// Ignored events don't refresh the table.
+	s.setApps(`{"apps": []}`)
+	s.events <- "event_stream_attached"
+	s.setApps(`{"apps": [{"id": "/db", "tasks": [
+		{"host": "d.mesos", "ports": [32000, 32001]}]}]}`)
+	s.events <- "status_update_event"
+	var names []string
+	timeout := time.After(5 * time.Second)
+	for len(names) < 3 {
+		select {
+		case name := <-changed:
+			names = append(names, name)
+		case <-timeout:
+			t.Fatalf("got changes %v, want the 3 names of web-group", names)
+		}
+	}
+	for _, name := range names {
+		if name == "_db._tcp.marathon.mesos" {
+			t.Errorf("got a change of the unchanged %s", name)
+		}
+	}
+	if _, err := lookup("_web-group._tcp.marathon.mesos"); err == nil {
+		t.Error("web-group still resolves after its tasks are gone")
+	}
+}
@@ -0,0 +1,127 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type mesosDNSResolver struct {
+	baseURL string
+	client  *http.Client
+}
+
+// mesosDNSRecord is an element of the Mesos-DNS /v1/services response.
+type mesosDNSRecord struct {
+	Service string `json:"service"`
+	Host    string `json:"host"`
+	IP      string `json:"ip"`
+	Port    string `json:"port"`
+}
+
+// NewMesosDNSResolver returns a resolver that looks up SRV records through
+// the HTTP API of Mesos-DNS at baseURL, e.g., "http://leader.mesos:8123" or
+// a Mesos-DNS endpoint behind admin router. It's useful where DNS queries to
+// the cluster are blocked but HTTP is allowed.
+//
+// The API does not report TTLs, so they're always reported as unknown. If
+// client is nil, http.DefaultClient is used.
+func NewMesosDNSResolver(baseURL string, client *http.Client) Resolver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &mesosDNSResolver{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  client,
+	}
+}
+
+func (r *mesosDNSResolver) LookupSRV(ctx context.Context, name string) (
+	addrs []*net.SRV, ttl time.Duration, err error) {
+
+	records, err := r.get(ctx, "services", name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Mesos-DNS answers unknown names with a single empty record.
+	seen := make(map[string]bool)
+	for _, rec := range records {
+		if rec.Host == "" || rec.Port == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(rec.Port, 10, 16)
+		if err != nil {
+			continue
+		}
+		key := net.JoinHostPort(rec.Host, rec.Port)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		addrs = append(addrs, &net.SRV{
+			Target: rec.Host,
+			Port:   uint16(port),
+			Weight: 1,
+		})
+	}
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name,
+			Server: r.baseURL, IsNotFound: true}
+	}
+	return addrs, 0, nil
+}
+
+// LookupIP returns the addresses of host through /v1/hosts.
+func (r *mesosDNSResolver) LookupIP(ctx context.Context, host string) (
+	ips []net.IP, ttl time.Duration, err error) {
+
+	records, err := r.get(ctx, "hosts", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, rec := range records {
+		if ip := net.ParseIP(rec.IP); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host,
+			Server: r.baseURL, IsNotFound: true}
+	}
+	return ips, 0, nil
+}
+
+// get queries the records of name from the endpoint /v1/<kind>/<name>.
+func (r *mesosDNSResolver) get(ctx context.Context, kind, name string) (
+	[]mesosDNSRecord, error) {
+
+	url := fmt.Sprintf("%s/v1/%s/%s", r.baseURL, kind, name)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name,
+			Server: r.baseURL, IsTemporary: true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &net.DNSError{Err: resp.Status, Name: name,
+			Server: r.baseURL, IsTemporary: true}
+	}
+
+	var records []mesosDNSRecord
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return nil, &net.DNSError{
+			Err:  fmt.Sprintf("invalid Mesos-DNS response: %s", err),
+			Name: name, Server: r.baseURL, IsTemporary: true}
+	}
+	return records, nil
+}
@@ -0,0 +1,102 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newMesosDNSStub serves the given JSON bodies by path, like the HTTP API of
+// Mesos-DNS.
+func newMesosDNSStub(t *testing.T, bodies map[string]string) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, ok := bodies[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, body)
+		}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestMesosDNSLookupSRV(t *testing.T) {
+	s := newMesosDNSStub(t, map[string]string{
+		"/v1/services/_app._tcp.marathon.mesos": `[
+			{"service": "_app._tcp.marathon.mesos", "host": "a.mesos",
+			 "ip": "10.0.0.1", "port": "31000"},
+			{"service": "_app._tcp.marathon.mesos", "host": "a.mesos",
+			 "ip": "10.0.0.1", "port": "31000"},
+			{"service": "_app._tcp.marathon.mesos", "host": "b.mesos",
+			 "ip": "10.0.0.2", "port": "31001"}
+		]`,
+		"/v1/services/_gone._tcp.marathon.mesos": `[
+			{"service": "", "host": "", "ip": "", "port": ""}
+		]`,
+		"/v1/services/_bad._tcp.marathon.mesos": `{`,
+	})
+	r := NewMesosDNSResolver(s.URL+"/", nil)
+
+	addrs, _, err := r.LookupSRV(context.Background(),
+		"_app._tcp.marathon.mesos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []net.SRV{
+		{Target: "a.mesos", Port: 31000, Weight: 1},
+		{Target: "b.mesos", Port: 31001, Weight: 1},
+	}
+	if len(addrs) != len(want) {
+		t.Fatalf("got %d records, want %d without duplicates", len(addrs),
+			len(want))
+	}
+	for i, addr := range addrs {
+		if *addr != want[i] {
+			t.Errorf("record %d: got %+v, want %+v", i, *addr, want[i])
+		}
+	}
+
+	_, _, err = r.LookupSRV(context.Background(), "_gone._tcp.marathon.mesos")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Errorf("empty record: got %v, want a not found error", err)
+	}
+	_, _, err = r.LookupSRV(context.Background(), "_bad._tcp.marathon.mesos")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsTemporary {
+		t.Errorf("invalid JSON: got %v, want a temporary error", err)
+	}
+	_, _, err = r.LookupSRV(context.Background(), "_404._tcp.marathon.mesos")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsTemporary {
+		t.Errorf("HTTP error: got %v, want a temporary error", err)
+	}
+}
+
+func TestMesosDNSLookupIP(t *testing.T) {
+	s := newMesosDNSStub(t, map[string]string{
+		"/v1/hosts/a.mesos": `[
+			{"host": "a.mesos.", "ip": "10.0.0.1"},
+			{"host": "a.mesos.", "ip": "fd00::1"}
+		]`,
+		"/v1/hosts/gone.mesos": `[{"host": "", "ip": ""}]`,
+	})
+	r := NewMesosDNSResolver(s.URL, nil).(HostResolver)
+
+	ips, _, err := r.LookupIP(context.Background(), "a.mesos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) ||
+		!ips[1].Equal(net.ParseIP("fd00::1")) {
+
+		t.Errorf("got %v, want 10.0.0.1 and fd00::1", ips)
+	}
+	_, _, err = r.LookupIP(context.Background(), "gone.mesos")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Errorf("empty record: got %v, want a not found error", err)
+	}
+}
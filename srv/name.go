@@ -0,0 +1,49 @@
+package srv
+
+import "strings"
+
+// DefaultProto is the protocol of short names when Config.DefaultProto is
+// empty.
+const DefaultProto = "tcp"
+
+// ExpandName turns the short forms of an SRV name into a full name, given
+// the default protocol and domain. The forms are checked in this order:
+//
+//  1. A name with a label that does not start with an underscore, e.g.,
+//     "_app._tcp.marathon.mesos", or with a trailing dot is already
+//     complete and kept as is.
+//  2. A name ending in a protocol label, "_tcp" or "_udp", gets the domain
+//     appended: "_app._udp" is "_app._udp.marathon.mesos" and
+//     "_http._app._tcp" is "_http._app._tcp.marathon.mesos".
+//  3. Any other name gets both the protocol and the domain appended: "_app"
+//     is "_app._tcp.marathon.mesos" and the named port form "_http._app" is
+//     "_http._app._tcp.marathon.mesos".
+//
+// Names are left alone if domain is empty.
+func ExpandName(name, proto, domain string) string {
+	if domain == "" || strings.HasSuffix(name, ".") {
+		return name
+	}
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if len(label) < 2 || label[0] != '_' {
+			return name
+		}
+	}
+	domain = strings.Trim(domain, ".")
+	switch strings.ToLower(labels[len(labels)-1]) {
+	case "_tcp", "_udp":
+		return strings.Join(labels, ".") + "." + domain
+	}
+	if proto == "" {
+		proto = DefaultProto
+	}
+	return strings.Join(labels, ".") + "._" + strings.TrimPrefix(proto, "_") +
+		"." + domain
+}
+
+// expand returns the full form of name according to the configured
+// defaults.
+func (c *cache) expand(name string) string {
+	return ExpandName(name, c.config.DefaultProto, c.config.DefaultDomain)
+}
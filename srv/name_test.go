@@ -0,0 +1,34 @@
+package srv
+
+import "testing"
+
+func TestExpandName(t *testing.T) {
+	const domain = "marathon.mesos"
+	tests := []struct {
+		name, proto, domain string
+		want                string
+	}{
+		{"_app", "", domain, "_app._tcp.marathon.mesos"},
+		{"_app", "udp", domain, "_app._udp.marathon.mesos"},
+		{"_app", "_udp", domain, "_app._udp.marathon.mesos"},
+		{"_app._udp", "", domain, "_app._udp.marathon.mesos"},
+		{"_app._TCP", "udp", domain, "_app._TCP.marathon.mesos"},
+		{"_http._app", "", domain, "_http._app._tcp.marathon.mesos"},
+		{"_http._app._tcp", "", domain, "_http._app._tcp.marathon.mesos"},
+		{"_app", "", ".mesos.", "_app._tcp.mesos"},
+		// Complete names are kept as is.
+		{"_app._tcp.marathon.mesos", "", domain, "_app._tcp.marathon.mesos"},
+		{"_app._tcp.", "", domain, "_app._tcp."},
+		{"_app..", "", domain, "_app.."},
+		{"_", "", domain, "_"},
+		// Without a default domain names are left alone.
+		{"_app", "", "", "_app"},
+	}
+	for _, test := range tests {
+		got := ExpandName(test.name, test.proto, test.domain)
+		if got != test.want {
+			t.Errorf("ExpandName(%q, %q, %q) = %q, want %q", test.name,
+				test.proto, test.domain, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package srv
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Policy is how a target is selected from a record set.
+type Policy string
+
+// Target selection policies
+const (
+	// PolicyRFC2782 picks the target by priority and weight, the default.
+	PolicyRFC2782 Policy = "rfc2782"
+	// PolicyFirst always picks the first target of the lowest priority.
+	PolicyFirst Policy = "first"
+	// PolicyRandom picks any target with the same probability, ignoring
+	// priorities and weights.
+	PolicyRandom Policy = "random"
+	// PolicyRoundRobin cycles through the targets in order, ignoring
+	// priorities and weights.
+	PolicyRoundRobin Policy = "round-robin"
+)
+
+// Policies is a slice of all target selection policies
+var Policies = []Policy{PolicyRFC2782, PolicyFirst, PolicyRandom,
+	PolicyRoundRobin}
+
+// ValidPolicy returns true if the policy is a valid target selection
+// policy, false otherwise.
+func ValidPolicy(policy Policy) bool {
+	for _, p := range Policies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// Override changes how the names matching Pattern are cached and routed.
+// Zero values keep the cache defaults.
+type Override struct {
+	// Pattern is a glob, as in path.Match, matched against names in lower
+	// case and without a trailing dot, e.g., "_kafka*._tcp.marathon.mesos".
+	// When several patterns match a name, the most specific one, with the
+	// most characters outside of wildcards, wins.
+	Pattern string
+	// TTL replaces the TTL of the record sets, it's not subject to MinTTL
+	// and MaxTTL.
+	TTL time.Duration
+	// NegativeTTL replaces Config.NegativeTTL for failed lookups.
+	NegativeTTL time.Duration
+	// Policy is how a target is selected, PolicyRFC2782 if it's empty.
+	Policy Policy
+	// Targets, if any, are served instead of looking the name up.
+	Targets []*net.SRV
+	// H2C makes the proxy send the cleartext HTTP requests for the names
+	// over HTTP/2 with prior knowledge, e.g., for gRPC services. It's not
+	// used by the cache.
+	H2C bool
+}
+
+// ParseTarget parses a target given as "host:port".
+func ParseTarget(target string) (*net.SRV, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	return &net.SRV{Target: host, Port: uint16(port), Weight: 1}, nil
+}
+
+// sortOverrides orders overrides so that the first match is the most
+// specific pattern, ties are broken alphabetically to keep the order
+// stable.
+func sortOverrides(overrides []Override) []Override {
+	sorted := append([]Override(nil), overrides...)
+	sort.Slice(sorted, func(i, j int) bool {
+		si, sj := specificity(sorted[i].Pattern), specificity(sorted[j].Pattern)
+		if si != sj {
+			return si > sj
+		}
+		return sorted[i].Pattern < sorted[j].Pattern
+	})
+	return sorted
+}
+
+// specificity returns the number of characters of pattern outside of
+// wildcards and character classes.
+func specificity(pattern string) int {
+	n := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+		case '\\':
+			i++
+			n++
+		case '[':
+			for i < len(pattern) && pattern[i] != ']' {
+				i++
+			}
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+func (c *cache) Override(name string) (Override, bool) {
+	if ov := c.override(c.expand(name)); ov != nil {
+		return *ov, true
+	}
+	return Override{}, false
+}
+
+// override returns the override of name, nil if there is none.
+func (c *cache) override(name string) *Override {
+	name = normalizeName(name)
+	for i := range c.config.Overrides {
+		if ok, _ := path.Match(c.config.Overrides[i].Pattern, name); ok {
+			return &c.config.Overrides[i]
+		}
+	}
+	return nil
+}
+
+// recordTTL returns how long the record set of name with the given TTL
+// should be cached.
+func (c *cache) recordTTL(name string, ttl time.Duration) time.Duration {
+	if ov := c.override(name); ov != nil && ov.TTL > 0 {
+		return ov.TTL
+	}
+	return c.ttl(ttl)
+}
+
+// negativeTTL returns how long a failed lookup of name should be cached.
+func (c *cache) negativeTTL(name string) time.Duration {
+	if ov := c.override(name); ov != nil && ov.NegativeTTL > 0 {
+		return ov.NegativeTTL
+	}
+	return c.config.NegativeTTL
+}
+
+// selectByPolicy picks a target from addrs according to the policy of the
+// override of name, next is the round robin position of the entry and may
+// be nil. recordLock must be held.
+func (c *cache) selectByPolicy(name string, addrs []*net.SRV, next *int) (
+	*net.SRV, error) {
+
+	policy := PolicyRFC2782
+	if ov := c.override(name); ov != nil && ov.Policy != "" {
+		policy = ov.Policy
+	}
+	if policy == PolicyRFC2782 {
+		return selectTarget(addrs, c.rnd)
+	}
+
+	var usable []*net.SRV
+	for _, addr := range addrs {
+		if addr.Target != "." && addr.Target != "" {
+			usable = append(usable, addr)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, errNoTarget
+	}
+	switch policy {
+	case PolicyFirst:
+		first := usable[0]
+		for _, addr := range usable[1:] {
+			if addr.Priority < first.Priority {
+				first = addr
+			}
+		}
+		return first, nil
+	case PolicyRandom:
+		return usable[c.rnd.Intn(len(usable))], nil
+	case PolicyRoundRobin:
+		if next == nil {
+			return usable[0], nil
+		}
+		target := usable[*next%len(usable)]
+		*next++
+		return target, nil
+	}
+	return nil, fmt.Errorf("unknown policy %q", policy)
+}
@@ -0,0 +1,84 @@
+package srv
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"time"
+)
+
+// Resolver looks up SRV record sets for the cache.
+type Resolver interface {
+	// LookupSRV returns the records of name along with their TTL, a TTL of
+	// 0 means the resolver could not determine it. The lookup is aborted
+	// when ctx is done.
+	LookupSRV(ctx context.Context, name string) (
+		addrs []*net.SRV, ttl time.Duration, err error)
+}
+
+// HostResolver is implemented by resolvers that can also look up the
+// addresses of SRV targets, the cache falls back to the system resolver for
+// resolvers that don't.
+type HostResolver interface {
+	// LookupIP returns the IPv4 and IPv6 addresses of host along with their
+	// TTL, a TTL of 0 means the resolver could not determine it.
+	LookupIP(ctx context.Context, host string) (
+		ips []net.IP, ttl time.Duration, err error)
+}
+
+// Notifier is implemented by resolvers that learn about changes to record
+// sets on their own. The cache registers a function with Notify that drops
+// the cached record set of the name that changed.
+type Notifier interface {
+	Notify(fn func(name string))
+}
+
+// notifyChanges calls every fn with the names whose record sets differ
+// between the tables old and new.
+func notifyChanges(old, new map[string][]*net.SRV, fns []func(name string)) {
+	for name, addrs := range new {
+		if !reflect.DeepEqual(old[name], addrs) {
+			for _, fn := range fns {
+				fn(name)
+			}
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			for _, fn := range fns {
+				fn(name)
+			}
+		}
+	}
+}
+
+type systemResolver struct{}
+
+// SystemResolver returns a resolver that uses the resolver of the operating
+// system.
+//
+// The system resolver does not expose TTLs, so they're always reported as
+// unknown.
+func SystemResolver() Resolver {
+	return systemResolver{}
+}
+
+func (systemResolver) LookupSRV(ctx context.Context, name string) (
+	addrs []*net.SRV, ttl time.Duration, err error) {
+
+	_, addrs, err = net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return addrs, 0, err
+}
+
+func (systemResolver) LookupIP(ctx context.Context, host string) (
+	ips []net.IP, ttl time.Duration, err error) {
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, 0, nil
+}
@@ -0,0 +1,72 @@
+package srv
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+)
+
+// errNoTarget is returned when a record set has nothing to choose from,
+// including the RFC 2782 "service is decidedly not available" answer of a
+// single "." target.
+var errNoTarget = errors.New("no usable SRV target")
+
+// selectTarget picks a record following RFC 2782: only the records with the
+// lowest priority are considered, and among those a target is chosen at
+// random with a probability proportional to its weight. Records with a
+// weight of 0 have a very small chance of being selected unless every
+// record in the priority has a weight of 0, in which case the choice is
+// uniform.
+func selectTarget(addrs []*net.SRV, rnd *rand.Rand) (*net.SRV, error) {
+	var candidates []*net.SRV
+	for _, addr := range addrs {
+		if addr.Target == "." || addr.Target == "" {
+			continue
+		}
+		switch {
+		case len(candidates) == 0 || addr.Priority < candidates[0].Priority:
+			candidates = []*net.SRV{addr}
+		case addr.Priority == candidates[0].Priority:
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errNoTarget
+	}
+
+	total := 0
+	for _, c := range candidates {
+		total += int(c.Weight)
+	}
+	if total == 0 {
+		return candidates[rnd.Intn(len(candidates))], nil
+	}
+
+	// As in RFC 2782, zero weight records are ordered first and a running
+	// sum is compared against a number in [0, total], so they are only
+	// picked when that number is exactly 0. Without them the number is
+	// drawn from [1, total], or the first record would also win the 0.
+	ordered := make([]*net.SRV, 0, len(candidates))
+	for _, c := range candidates {
+		if c.Weight == 0 {
+			ordered = append(ordered, c)
+		}
+	}
+	n := rnd.Intn(total) + 1
+	if len(ordered) > 0 {
+		n = rnd.Intn(total + 1)
+	}
+	for _, c := range candidates {
+		if c.Weight != 0 {
+			ordered = append(ordered, c)
+		}
+	}
+	sum := 0
+	for _, c := range ordered {
+		sum += int(c.Weight)
+		if sum >= n {
+			return c, nil
+		}
+	}
+	return ordered[len(ordered)-1], nil
+}
@@ -0,0 +1,96 @@
+package srv
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestSelectTarget(t *testing.T) {
+	const picks = 10000
+	tests := []struct {
+		name  string
+		addrs []*net.SRV
+		// want is the expected share of picks of each target, within
+		// tolerance.
+		want map[string]float64
+	}{
+		{
+			name: "lowest priority only",
+			addrs: []*net.SRV{
+				{Target: "backup", Priority: 1, Weight: 100},
+				{Target: "a", Priority: 0, Weight: 1},
+				{Target: "b", Priority: 0, Weight: 1},
+			},
+			want: map[string]float64{"a": 0.5, "b": 0.5},
+		},
+		{
+			name: "proportional to weight",
+			addrs: []*net.SRV{
+				{Target: "a", Weight: 3},
+				{Target: "b", Weight: 1},
+			},
+			want: map[string]float64{"a": 0.75, "b": 0.25},
+		},
+		{
+			name: "zero weight rarely picked",
+			addrs: []*net.SRV{
+				{Target: "zero", Weight: 0},
+				{Target: "a", Weight: 99},
+			},
+			want: map[string]float64{"zero": 0.01, "a": 0.99},
+		},
+		{
+			name: "all zero weights uniform",
+			addrs: []*net.SRV{
+				{Target: "a"},
+				{Target: "b"},
+				{Target: "c"},
+				{Target: "d"},
+			},
+			want: map[string]float64{"a": 0.25, "b": 0.25, "c": 0.25, "d": 0.25},
+		},
+		{
+			name: "unavailable targets skipped",
+			addrs: []*net.SRV{
+				{Target: ".", Priority: 0, Weight: 100},
+				{Target: "a", Priority: 1, Weight: 1},
+			},
+			want: map[string]float64{"a": 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			counts := make(map[string]int)
+			for i := 0; i < picks; i++ {
+				target, err := selectTarget(test.addrs, rnd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				counts[target.Target]++
+			}
+			for target, n := range counts {
+				if _, ok := test.want[target]; !ok {
+					t.Errorf("%s picked %d times, want never", target, n)
+				}
+			}
+			for target, share := range test.want {
+				got := float64(counts[target]) / picks
+				if got < share-0.02 || got > share+0.02 {
+					t.Errorf("%s picked %.3f of the time, want %.3f", target,
+						got, share)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectTargetNoTarget(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, addrs := range [][]*net.SRV{nil, {{Target: "."}}} {
+		if _, err := selectTarget(addrs, rnd); err != errNoTarget {
+			t.Errorf("%v: got %v, want errNoTarget", addrs, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package srv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotVersion is bumped whenever the snapshot format changes, snapshots
+// of another version are ignored.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int             `json:"version"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Name    string           `json:"name"`
+	Expire  time.Time        `json:"expire"`
+	Targets []snapshotTarget `json:"targets"`
+}
+
+type snapshotTarget struct {
+	Target   string `json:"target"`
+	Port     uint16 `json:"port"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+}
+
+// loadSnapshot fills the cache with the record sets of the snapshot at
+// Config.SnapshotPath.
+//
+// The record sets are loaded as expiring now, whenever they were saved:
+// they're served for Config.MaxStale from then on and the first Get of a
+// name revalidates it.
+func (c *cache) loadSnapshot() error {
+	data, err := ioutil.ReadFile(c.config.SnapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	if snap.Version != snapshotVersion {
+		return nil
+	}
+
+	now := time.Now()
+	c.recordLock.Lock()
+	defer c.recordLock.Unlock()
+	// Entries are stored from the most to the least recently used, insert
+	// them in reverse to restore that order.
+	for i := len(snap.Entries) - 1; i >= 0; i-- {
+		e := snap.Entries[i]
+		if len(e.Targets) == 0 {
+			continue
+		}
+		addrs := make([]*net.SRV, 0, len(e.Targets))
+		for _, t := range e.Targets {
+			addrs = append(addrs, &net.SRV{
+				Target:   t.Target,
+				Port:     t.Port,
+				Priority: t.Priority,
+				Weight:   t.Weight,
+			})
+		}
+		c.set(e.Name, entry{addrs: addrs, expire: now, next: new(int)})
+	}
+	return nil
+}
+
+// saveSnapshot writes the record sets in the cache to Config.SnapshotPath,
+// failed lookups are not saved.
+func (c *cache) saveSnapshot() error {
+	snap := snapshot{Version: snapshotVersion}
+	c.recordLock.Lock()
+	for el := c.record.ll.Front(); el != nil; el = el.Next() {
+		item := el.Value.(*lruItem)
+		if item.entry.addrs == nil {
+			continue
+		}
+		e := snapshotEntry{Name: item.name, Expire: item.entry.expire}
+		for _, addr := range item.entry.addrs {
+			e.Targets = append(e.Targets, snapshotTarget{
+				Target:   addr.Target,
+				Port:     addr.Port,
+				Priority: addr.Priority,
+				Weight:   addr.Weight,
+			})
+		}
+		snap.Entries = append(snap.Entries, e)
+	}
+	c.recordLock.Unlock()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a truncated
+	// snapshot behind.
+	dir, file := filepath.Split(c.config.SnapshotPath)
+	tmp, err := ioutil.TempFile(dir, file)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.config.SnapshotPath)
+}
+
+func (c *cache) startSnapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.saveSnapshot(); err != nil {
+				log.Print("error saving SRV cache snapshot: ", err)
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSnapshotRoundTrip saves a cache, ages the snapshot and checks the
+// record sets are loaded in the same order with the full MaxStale window.
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	targets := staticTargets{
+		{Target: "a.mesos", Port: 80, Priority: 1, Weight: 2},
+		{Target: "b.mesos", Port: 8080, Priority: 2, Weight: 3},
+	}
+	c := New(Config{Timeout: time.Minute, Resolver: targets,
+		SnapshotPath: path})
+	names := []string{"_a._tcp.marathon.mesos", "_b._tcp.marathon.mesos"}
+	for _, name := range names {
+		if _, _, err := c.Get(context.Background(), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot is older than MaxStale, loaded entries are still served.
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	for i := range snap.Entries {
+		snap.Entries[i].Expire = time.Now().Add(-time.Hour)
+	}
+	if data, err = json.Marshal(snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := time.Now()
+	// The lookups to refresh the loaded entries never complete.
+	r := &fakeResolver{release: make(chan struct{})}
+	c = New(Config{Timeout: time.Minute, MaxStale: time.Minute, Resolver: r,
+		SnapshotPath: path})
+	defer c.Close()
+	entries := c.Entries()
+	if len(entries) != len(names) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(names))
+	}
+	for i, e := range entries {
+		// Entries are listed from the most recently used.
+		if want := names[len(names)-1-i]; e.Name != want {
+			t.Errorf("entry %d: got %s, want %s", i, e.Name, want)
+		}
+		if e.Expire.Before(loaded) || !e.Stale {
+			t.Errorf("%s: expires at %s, stale %t, want stale from %s",
+				e.Name, e.Expire, e.Stale, loaded)
+		}
+		if !reflect.DeepEqual(e.Targets, []*net.SRV(targets)) {
+			t.Errorf("%s: got targets %v, want %v", e.Name, e.Targets,
+				targets)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if host, _, err := c.Get(ctx, names[0]); err != nil || host != "a.mesos" {
+		t.Errorf("got %s, %v, want the stale a.mesos", host, err)
+	}
+}
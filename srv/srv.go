@@ -1,89 +1,555 @@
 package srv
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math/rand"
 	"net"
 	"sync"
 	"time"
 )
 
-// Cache stores the results of successful SRV record queries.
+// Cache stores the results of SRV record queries, names may be given in the
+// short forms of ExpandName.
+//
+// Get returns one target of the cached record set, chosen according to the
+// priority and weight rules of RFC 2782 on every call, unless an Override
+// sets another Policy for the name. Failed lookups are cached as well and
+// reported as a *LookupError. Concurrent misses for the same name share a
+// single lookup.
+//
+// Once a record set expires it keeps being served for up to Config.MaxStale
+// while it's refreshed in the background, a failed refresh leaves the last
+// known good record set in place.
+//
+// Get returns early with the error of ctx if it is done before the lookup
+// completes, the lookup itself is only aborted by Close.
 type Cache interface {
-	Get(name string) (host string, port uint16, err error)
+	Get(ctx context.Context, name string) (host string, port uint16, err error)
+	Stats() Stats
+	// Entries returns the cached names from the most to the least recently
+	// used.
+	Entries() []EntryInfo
+	// Invalidate drops the entry of name, the next Get looks it up again.
+	Invalidate(name string)
+	// Flush drops all entries.
+	Flush()
+	// Prewarm looks up names that are not cached yet and waits for the
+	// lookups to complete, the first failed lookup is returned.
+	Prewarm(ctx context.Context, names []string) error
+	// Watch returns a channel of the changes to the record set of name, as
+	// detected whenever it's refreshed. The name is kept fresh while it's
+	// watched. Events are dropped if the receiver falls behind, cancel
+	// stops the watch and closes the channel.
+	Watch(name string) (events <-chan Event, cancel func())
+	// Override returns the override matching name, expanded as by Get, and
+	// false if there is none.
+	Override(name string) (Override, bool)
+	// Close stops the background work of the cache, aborts the lookups in
+	// flight and saves the snapshot, if enabled. Get fails with ErrClosed
+	// afterwards.
+	Close() error
+}
+
+// ErrClosed is returned by Get once the cache is closed.
+var ErrClosed = errors.New("SRV cache is closed")
+
+// Stats stores counters of the cache activity.
+type Stats struct {
+	// Lookups is the number of lookups sent to the resolver.
+	Lookups uint64 `json:"lookups"`
+	// HostLookups is the number of address lookups of SRV targets.
+	HostLookups uint64 `json:"host_lookups"`
+	// Coalesced is the number of misses that waited for a lookup already in
+	// flight instead of starting their own.
+	Coalesced uint64 `json:"coalesced"`
+	// Evictions is the number of entries dropped to stay within
+	// Config.MaxEntries.
+	Evictions uint64 `json:"evictions"`
+	// Entries is the number of names currently cached.
+	Entries int `json:"entries"`
+}
+
+// EntryInfo describes a cached name.
+type EntryInfo struct {
+	Name   string    `json:"name"`
+	Expire time.Time `json:"expire"`
+	Stale  bool      `json:"stale"`
+	// Source is the name of the Chain backend that answered, if any.
+	Source  string     `json:"source,omitempty"`
+	Targets []*net.SRV `json:"targets,omitempty"`
+	// Addresses are the cached IP addresses of the targets.
+	Addresses map[string][]net.IP `json:"addresses,omitempty"`
+	Error     string              `json:"error,omitempty"`
+}
+
+// Config stores the cache configuration.
+type Config struct {
+	// Timeout is how long a record set is cached when the resolver cannot
+	// report its TTL.
+	Timeout time.Duration
+	// MinTTL and MaxTTL clamp the TTL of a record set, a zero MaxTTL means
+	// there is no ceiling.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is how long a failed lookup is cached, a zero NegativeTTL
+	// disables negative caching.
+	NegativeTTL time.Duration
+	// MaxStale is how long after expiring a record set may still be served
+	// while it's being refreshed, a zero MaxStale disables serving stale
+	// records.
+	MaxStale time.Duration
+	// MaxEntries is the maximum number of names cached, the least recently
+	// used name is evicted to make room for a new one. A zero MaxEntries
+	// means there is no limit.
+	MaxEntries int
+	// SnapshotPath is the file the cache is saved to on Close and every
+	// SnapshotInterval, and loaded from by New. Loaded record sets expire
+	// at load time, so they're only served within MaxStale from then on and
+	// are refreshed on first use. An empty SnapshotPath disables snapshots and
+	// a zero SnapshotInterval only saves on Close.
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+	// ResolveTargets makes Get return an IP address of the selected target
+	// instead of its host name. The addresses are cached with their own TTL,
+	// subject to the same limits as record sets, and looked up through the
+	// Resolver if it implements HostResolver.
+	ResolveTargets bool
+	// Overrides change the TTLs and routing of the names they match.
+	Overrides []Override
+	// DefaultDomain and DefaultProto complete short names, e.g., "_app" or
+	// "_http._app", as described in ExpandName. An empty DefaultDomain
+	// disables short names and an empty DefaultProto is DefaultProto.
+	DefaultDomain string
+	DefaultProto  string
+	// Resolver is used to look up records, the system resolver is used if
+	// it's nil. If it implements Notifier, the cache drops the names it
+	// reports as changed, and if it implements io.Closer it's closed along
+	// with the cache.
+	Resolver Resolver
+}
+
+// LookupError is returned by Get when a name could not be resolved.
+type LookupError struct {
+	Name string
+	Err  error
+	// NotFound is true if the name does not exist.
+	NotFound bool
+	// Cached is true if the error was served from the cache instead of
+	// coming from a lookup made by this call.
+	Cached bool
+}
+
+func (e *LookupError) Error() string {
+	if e.Cached {
+		return fmt.Sprintf("error updating SRV cache (cached): %s", e.Err)
+	}
+	return fmt.Sprintf("error updating SRV cache: %s", e.Err)
 }
 
 type entry struct {
-	srv    *net.SRV
-	expire time.Duration
+	addrs  []*net.SRV
+	ips    []net.IP
+	err    *LookupError
+	source string
+	expire time.Time
+	// retry is the earliest time a stale entry is refreshed again after a
+	// failed refresh.
+	retry time.Time
+	// next is the round robin position within addrs, kept across refreshes
+	// and dropped with the entry.
+	next *int
+}
+
+// call is a lookup in flight, done is closed once addrs, or ips for an
+// address lookup, or err is set.
+type call struct {
+	done  chan struct{}
+	addrs []*net.SRV
+	ips   []net.IP
+	err   *LookupError
 }
 
 type cache struct {
-	duration   time.Duration
-	record     map[string]entry
+	ctx        context.Context
+	cancel     context.CancelFunc
+	config     Config
+	record     *lru
+	calls      map[string]*call
+	hosts      *lru
+	hostCalls  map[string]*call
+	watches    map[string]*watch
+	stats      Stats
 	recordLock *sync.Mutex
+	rnd        *rand.Rand
+	closeOnce  *sync.Once
 }
 
 // New returns a new cache.
-func New(duration time.Duration) Cache {
+func New(config Config) Cache {
+	if config.Resolver == nil {
+		config.Resolver = SystemResolver()
+	}
+	config.Overrides = sortOverrides(config.Overrides)
+	ctx, cancel := context.WithCancel(context.Background())
 	c := &cache{
-		duration:   duration,
-		record:     make(map[string]entry),
+		ctx:        ctx,
+		cancel:     cancel,
+		config:     config,
+		record:     newLRU(config.MaxEntries),
+		calls:      make(map[string]*call),
+		hosts:      newLRU(config.MaxEntries),
+		hostCalls:  make(map[string]*call),
+		watches:    make(map[string]*watch),
 		recordLock: &sync.Mutex{},
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		closeOnce:  &sync.Once{},
+	}
+	if n, ok := config.Resolver.(Notifier); ok {
+		n.Notify(c.Invalidate)
 	}
-	go c.startGC(duration * 10)
+	if config.SnapshotPath != "" {
+		if err := c.loadSnapshot(); err != nil {
+			log.Print("error loading SRV cache snapshot: ", err)
+		}
+		if config.SnapshotInterval > 0 {
+			go c.startSnapshots(config.SnapshotInterval)
+		}
+	}
+	go c.startGC(config.Timeout * 10)
 	return c
 }
 
+// defaultGCInterval is how often expired entries are dropped when
+// Config.Timeout is zero.
+const defaultGCInterval = time.Minute
+
 func (c *cache) startGC(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultGCInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
 		c.flushExpired()
-		time.Sleep(interval)
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
 	}
 }
 
 func (c *cache) flushExpired() {
 	c.recordLock.Lock()
-	for k, v := range c.record {
-		if v.expired() {
-			delete(c.record, k)
-		}
-	}
+	c.record.removeIf(func(name string, e entry) bool {
+		return !c.servable(e)
+	})
+	c.hosts.removeIf(func(name string, e entry) bool {
+		return !c.servable(e)
+	})
 	c.recordLock.Unlock()
 }
 
-func (c *cache) newEntry(srv *net.SRV) entry {
+func (c *cache) newEntry(name string, addrs []*net.SRV,
+	ttl time.Duration) entry {
+
+	e := entry{
+		addrs:  addrs,
+		expire: time.Now().Add(c.recordTTL(name, ttl)),
+		next:   new(int),
+	}
+	if old, ok := c.record.peek(name); ok && old.next != nil {
+		e.next = old.next
+	}
+	return e
+}
+
+// ttl returns how long a record set with the given TTL should be cached, a
+// TTL of 0 means the resolver could not report one.
+func (c *cache) ttl(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = c.config.Timeout
+	}
+	if ttl < c.config.MinTTL {
+		ttl = c.config.MinTTL
+	}
+	if c.config.MaxTTL > 0 && ttl > c.config.MaxTTL {
+		ttl = c.config.MaxTTL
+	}
+	return ttl
+}
+
+func newNegativeEntry(err *LookupError, ttl time.Duration) entry {
 	return entry{
-		srv:    srv,
-		expire: time.Duration(time.Now().Unix()) + (c.duration / time.Second),
+		err:    err,
+		expire: time.Now().Add(ttl),
+	}
+}
+
+func newLookupError(name string, err error) *LookupError {
+	dnsErr, ok := err.(*net.DNSError)
+	return &LookupError{
+		Name:     name,
+		Err:      err,
+		NotFound: ok && dnsErr.IsNotFound,
+	}
+}
+
+// lookup returns the lookup in flight for name, starting one if there is
+// none, recordLock must be held.
+func (c *cache) lookup(name string) *call {
+	if cl, ok := c.calls[name]; ok {
+		c.stats.Coalesced++
+		return cl
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[name] = cl
+	c.stats.Lookups++
+	go c.resolve(name, cl)
+	return cl
+}
+
+// resolve queries the resolver for name and stores the result in both the
+// cache and cl.
+func (c *cache) resolve(name string, cl *call) {
+	var addrs []*net.SRV
+	var ttl time.Duration
+	var source string
+	var err error
+	if ov := c.override(name); ov != nil && len(ov.Targets) > 0 {
+		addrs, source = ov.Targets, "override"
+	} else if ch, ok := c.config.Resolver.(*Chain); ok {
+		addrs, ttl, source, err = ch.lookupSRVSource(c.ctx, name)
+	} else {
+		addrs, ttl, err = c.config.Resolver.LookupSRV(c.ctx, name)
+	}
+
+	c.recordLock.Lock()
+	defer c.recordLock.Unlock()
+	delete(c.calls, name)
+	if err != nil {
+		cl.err = newLookupError(name, err)
+		if old, ok := c.record.peek(name); ok && old.addrs != nil &&
+			c.servable(old) {
+
+			// Keep serving the last known good record set, but don't retry
+			// on every request.
+			old.retry = time.Now().Add(c.negativeTTL(name))
+			c.set(name, old)
+		} else if ttl := c.negativeTTL(name); ttl > 0 {
+			c.set(name, newNegativeEntry(cl.err, ttl))
+		}
+		// A name that's gone has lost all its targets.
+		if cl.err.NotFound {
+			c.notifyWatchers(name, nil)
+		}
+	} else {
+		cl.addrs = addrs
+		c.notifyWatchers(name, addrs)
+		e := c.newEntry(name, addrs, ttl)
+		e.source = source
+		c.set(name, e)
+		if c.config.ResolveTargets {
+			c.prefetchHosts(addrs)
+		}
+	}
+	close(cl.done)
+}
+
+// pick selects a target from addrs, recordLock must be held.
+func (c *cache) pick(name string, addrs []*net.SRV, next *int) (
+	*net.SRV, error) {
+
+	target, err := c.selectByPolicy(name, addrs, next)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting target for %s: %s", name, err)
+	}
+	return target, nil
+}
+
+// set stores e as the entry of name, recordLock must be held.
+func (c *cache) set(name string, e entry) {
+	c.stats.Evictions += uint64(c.record.set(name, e))
+}
+
+func (e *entry) expired() bool {
+	return time.Now().After(e.expire)
+}
+
+// servable returns true if e has not expired or is a record set that is
+// still within the stale window.
+func (c *cache) servable(e entry) bool {
+	if !e.expired() {
+		return true
 	}
+	return (e.addrs != nil || e.ips != nil) &&
+		time.Now().Before(e.expire.Add(c.config.MaxStale))
 }
 
-// Returns the updated values
-func (c *cache) update(name string) (host string, port uint16, err error) {
-	_, addrs, err := net.LookupSRV("", "", name)
+func (c *cache) Get(ctx context.Context, name string) (
+	host string, port uint16, err error) {
+
+	target, err := c.getTarget(ctx, c.expand(name))
 	if err != nil {
-		return "", 0, fmt.Errorf("error updating SRV cache: %s", err)
+		return "", 0, err
 	}
+	return c.address(ctx, target)
+}
+
+// getTarget returns the SRV record selected for name.
+func (c *cache) getTarget(ctx context.Context, name string) (
+	*net.SRV, error) {
 
-	srvEntry := addrs[0]
-	host = srvEntry.Target
-	port = srvEntry.Port
+	if c.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
 	c.recordLock.Lock()
-	c.record[name] = c.newEntry(srvEntry)
+	v, ok := c.record.get(name)
+	if ok && !v.expired() {
+		defer c.recordLock.Unlock()
+		if v.err != nil {
+			cached := *v.err
+			cached.Cached = true
+			return nil, &cached
+		}
+		return c.pick(name, v.addrs, v.next)
+	}
+	if ok && c.servable(v) {
+		defer c.recordLock.Unlock()
+		if _, inFlight := c.calls[name]; !inFlight &&
+			time.Now().After(v.retry) {
+
+			c.lookup(name)
+		}
+		return c.pick(name, v.addrs, v.next)
+	}
+	cl := c.lookup(name)
 	c.recordLock.Unlock()
-	return host, port, nil
+
+	select {
+	case <-cl.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, ErrClosed
+	}
+	if cl.err != nil {
+		return nil, cl.err
+	}
+	c.recordLock.Lock()
+	defer c.recordLock.Unlock()
+	v, _ = c.record.peek(name)
+	return c.pick(name, cl.addrs, v.next)
 }
 
-func (e *entry) expired() bool {
-	return time.Duration(time.Now().Unix()) > e.expire
+func (c *cache) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.cancel()
+		if c.config.SnapshotPath != "" {
+			err = c.saveSnapshot()
+		}
+		if closer, ok := c.config.Resolver.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (c *cache) Stats() Stats {
+	c.recordLock.Lock()
+	defer c.recordLock.Unlock()
+	stats := c.stats
+	stats.Entries = c.record.len()
+	return stats
+}
+
+func (c *cache) Entries() []EntryInfo {
+	c.recordLock.Lock()
+	defer c.recordLock.Unlock()
+	infos := make([]EntryInfo, 0, c.record.len())
+	for el := c.record.ll.Front(); el != nil; el = el.Next() {
+		item := el.Value.(*lruItem)
+		info := EntryInfo{
+			Name:    item.name,
+			Expire:  item.entry.expire,
+			Stale:   item.entry.expired(),
+			Source:  item.entry.source,
+			Targets: item.entry.addrs,
+		}
+		for _, addr := range item.entry.addrs {
+			if host, ok := c.hosts.peek(addr.Target); ok && host.ips != nil {
+				if info.Addresses == nil {
+					info.Addresses = make(map[string][]net.IP)
+				}
+				info.Addresses[addr.Target] = host.ips
+			}
+		}
+		if item.entry.err != nil {
+			info.Error = item.entry.err.Err.Error()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func (c *cache) Invalidate(name string) {
+	c.recordLock.Lock()
+	defer c.recordLock.Unlock()
+	name = c.expand(name)
+	c.record.remove(name)
+	if w, ok := c.watches[name]; ok {
+		w.wake()
+	}
 }
 
-func (c *cache) Get(name string) (host string, port uint16, err error) {
+func (c *cache) Flush() {
+	c.recordLock.Lock()
+	defer c.recordLock.Unlock()
+	c.record.removeIf(func(string, entry) bool {
+		return true
+	})
+	c.hosts.removeIf(func(string, entry) bool {
+		return true
+	})
+	for _, w := range c.watches {
+		w.wake()
+	}
+}
+
+func (c *cache) Prewarm(ctx context.Context, names []string) error {
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	var calls []*call
 	c.recordLock.Lock()
-	v, ok := c.record[name]
+	for _, name := range names {
+		name = c.expand(name)
+		if v, ok := c.record.peek(name); ok && !v.expired() {
+			continue
+		}
+		calls = append(calls, c.lookup(name))
+	}
 	c.recordLock.Unlock()
-	if ok && !v.expired() {
-		return v.srv.Target, v.srv.Port, nil
+
+	var err error
+	for _, cl := range calls {
+		select {
+		case <-cl.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.ctx.Done():
+			return ErrClosed
+		}
+		if cl.err != nil && err == nil {
+			err = cl.err
+		}
 	}
-	return c.update(name)
+	return err
 }
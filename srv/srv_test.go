@@ -0,0 +1,125 @@
+package srv
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers every name with a single target once release is
+// closed, counting the lookups.
+type fakeResolver struct {
+	release chan struct{}
+	lookups int32
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, name string) (
+	[]*net.SRV, time.Duration, error) {
+
+	atomic.AddInt32(&r.lookups, 1)
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+	return []*net.SRV{{Target: "a.mesos", Port: 80, Weight: 1}}, time.Minute,
+		nil
+}
+
+func TestCacheCoalescesMisses(t *testing.T) {
+	const callers = 10
+	r := &fakeResolver{release: make(chan struct{})}
+	c := New(Config{Timeout: time.Second, Resolver: r})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := c.Get(context.Background(), "_app._tcp.marathon.mesos")
+			errs <- err
+		}()
+	}
+	// Wait for every caller to be waiting on the lookup before answering.
+	for c.Stats().Coalesced < callers-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(r.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	stats := c.Stats()
+	if n := atomic.LoadInt32(&r.lookups); n != 1 {
+		t.Errorf("resolver got %d lookups, want 1", n)
+	}
+	if stats.Lookups != 1 || stats.Coalesced != callers-1 {
+		t.Errorf("got %d lookups and %d coalesced, want 1 and %d",
+			stats.Lookups, stats.Coalesced, callers-1)
+	}
+
+	// Hits are neither lookups nor coalesced.
+	if _, _, err := c.Get(context.Background(),
+		"_app._tcp.marathon.mesos"); err != nil {
+
+		t.Fatal(err)
+	}
+	if after := c.Stats(); after.Lookups != 1 ||
+		after.Coalesced != callers-1 {
+
+		t.Errorf("hit changed the counters to %+v", after)
+	}
+}
+
+func TestCacheRoundRobin(t *testing.T) {
+	r := staticTargets{
+		{Target: "a.mesos", Port: 80},
+		{Target: "b.mesos", Port: 80},
+		{Target: "c.mesos", Port: 80},
+	}
+	c := New(Config{
+		Timeout:  time.Minute,
+		Resolver: r,
+		Overrides: []Override{
+			{Pattern: "_app._tcp.*", Policy: PolicyRoundRobin},
+		},
+	})
+	defer c.Close()
+
+	get := func() string {
+		t.Helper()
+		target, _, err := c.Get(context.Background(), "_app._tcp.marathon.mesos")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return target
+	}
+	for i, want := range []string{"a.mesos", "b.mesos", "c.mesos", "a.mesos"} {
+		if got := get(); got != want {
+			t.Errorf("pick %d: got %s, want %s", i, got, want)
+		}
+	}
+	// The position is dropped along with the entry.
+	c.Invalidate("_app._tcp.marathon.mesos")
+	if got := get(); got != "a.mesos" {
+		t.Errorf("after invalidation: got %s, want a.mesos", got)
+	}
+}
+
+// staticTargets answers every name with the same targets.
+type staticTargets []*net.SRV
+
+func (r staticTargets) LookupSRV(ctx context.Context, name string) (
+	[]*net.SRV, time.Duration, error) {
+
+	return r, time.Minute, nil
+}
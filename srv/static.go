@@ -0,0 +1,166 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// staticRegistry is the format of the file read by the static resolver,
+// e.g.:
+//
+//	{
+//	  "services": {
+//	    "_app._tcp.marathon.mesos": ["127.0.0.1:8080", "127.0.0.1:8081"]
+//	  }
+//	}
+type staticRegistry struct {
+	Services map[string][]string `json:"services"`
+}
+
+// StaticResolver resolves names from a JSON file that maps service names to
+// host:port targets, e.g., for local development without a cluster. The
+// file is checked for changes every interval and reloaded without a
+// restart, a file that fails to load leaves the previous table in place.
+type StaticResolver struct {
+	path     string
+	interval time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	modTime   time.Time
+	size      int64
+	table     map[string][]*net.SRV
+	notify    []func(name string)
+	tableLock *sync.Mutex
+}
+
+// defaultStaticInterval is how often the registry file is checked for
+// changes when no positive interval is given.
+const defaultStaticInterval = time.Second
+
+// NewStaticResolver returns a resolver for the registry file at path, it
+// fails if the file can't be loaded initially. The file is checked for
+// changes every interval, every second if interval is not positive.
+func NewStaticResolver(path string, interval time.Duration) (
+	*StaticResolver, error) {
+
+	if interval <= 0 {
+		interval = defaultStaticInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &StaticResolver{
+		path:      path,
+		interval:  interval,
+		ctx:       ctx,
+		cancel:    cancel,
+		tableLock: &sync.Mutex{},
+	}
+	if _, err := r.reload(); err != nil {
+		cancel()
+		return nil, err
+	}
+	go r.startWatching()
+	return r, nil
+}
+
+// LookupSRV returns the targets listed for name. The file has no TTLs, a
+// reload notifies the names that changed instead.
+func (r *StaticResolver) LookupSRV(ctx context.Context, name string) (
+	addrs []*net.SRV, ttl time.Duration, err error) {
+
+	r.tableLock.Lock()
+	defer r.tableLock.Unlock()
+	addrs, ok := r.table[normalizeName(name)]
+	if !ok {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name,
+			Server: r.path, IsNotFound: true}
+	}
+	return addrs, 0, nil
+}
+
+// Notify registers fn to be called with every name whose targets change
+// when the file is reloaded.
+func (r *StaticResolver) Notify(fn func(name string)) {
+	r.tableLock.Lock()
+	defer r.tableLock.Unlock()
+	r.notify = append(r.notify, fn)
+}
+
+// Close stops watching the file.
+func (r *StaticResolver) Close() error {
+	r.cancel()
+	return nil
+}
+
+func (r *StaticResolver) startWatching() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if reloaded, err := r.reload(); err != nil {
+				log.Print("error reloading static registry: ", err)
+			} else if reloaded {
+				log.Printf("reloaded static registry %s", r.path)
+			}
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// reload loads the file if it changed since the last load and returns
+// whether it did.
+func (r *StaticResolver) reload() (bool, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false, err
+	}
+	r.tableLock.Lock()
+	unchanged := r.table != nil && info.ModTime().Equal(r.modTime) &&
+		info.Size() == r.size
+	r.tableLock.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return false, err
+	}
+	var registry staticRegistry
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return false, fmt.Errorf("%s: %s", r.path, err)
+	}
+	table := make(map[string][]*net.SRV, len(registry.Services))
+	for name, targets := range registry.Services {
+		for _, target := range targets {
+			addr, err := ParseTarget(target)
+			if err != nil {
+				return false, fmt.Errorf("%s: %s: %s", r.path, name, err)
+			}
+			key := normalizeName(name)
+			table[key] = append(table[key], addr)
+		}
+	}
+
+	r.tableLock.Lock()
+	old := r.table
+	r.table = table
+	r.modTime = info.ModTime()
+	r.size = info.Size()
+	notify := r.notify
+	r.tableLock.Unlock()
+	if old != nil {
+		notifyChanges(old, table, notify)
+	}
+	return true, nil
+}
@@ -0,0 +1,179 @@
+package srv
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// EventType is the kind of change to a record set.
+type EventType string
+
+// Changes reported to watchers
+const (
+	TargetAdded      EventType = "added"
+	TargetRemoved    EventType = "removed"
+	TargetReweighted EventType = "reweighted"
+)
+
+// watchBuffer is the number of events buffered for each watcher, events
+// are dropped for watchers that fall further behind.
+const watchBuffer = 64
+
+// Event is a change to the record set of a watched name.
+type Event struct {
+	Name   string    `json:"name"`
+	Type   EventType `json:"type"`
+	Target *net.SRV  `json:"target"`
+	Time   time.Time `json:"time"`
+}
+
+// watch tracks the watchers of a name and the record set they last saw.
+type watch struct {
+	subs  map[chan Event]bool
+	last  []*net.SRV
+	known bool
+	stop  chan struct{}
+	// refresh wakes the refresh loop when the entry is dropped.
+	refresh chan struct{}
+}
+
+func (w *watch) wake() {
+	select {
+	case w.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *cache) Watch(name string) (<-chan Event, func()) {
+	name = c.expand(name)
+	ch := make(chan Event, watchBuffer)
+	c.recordLock.Lock()
+	w, ok := c.watches[name]
+	if !ok {
+		w = &watch{subs: make(map[chan Event]bool), stop: make(chan struct{}),
+			refresh: make(chan struct{}, 1)}
+		if v, ok := c.record.peek(name); ok && v.addrs != nil {
+			w.last = v.addrs
+			w.known = true
+		}
+		c.watches[name] = w
+		go c.refreshWatched(name, w)
+	}
+	w.subs[ch] = true
+	c.recordLock.Unlock()
+
+	cancel := func() {
+		c.recordLock.Lock()
+		defer c.recordLock.Unlock()
+		if !w.subs[ch] {
+			return
+		}
+		delete(w.subs, ch)
+		close(ch)
+		if len(w.subs) == 0 {
+			delete(c.watches, name)
+			close(w.stop)
+		}
+	}
+	return ch, cancel
+}
+
+// refreshWatched keeps a watched name fresh even without traffic, so
+// changes are noticed, until the last watcher is gone.
+func (c *cache) refreshWatched(name string, w *watch) {
+	for {
+		c.recordLock.Lock()
+		var wait time.Duration
+		if v, ok := c.record.peek(name); ok {
+			wait = time.Until(v.expire)
+		}
+		var cl *call
+		if wait <= 0 {
+			cl = c.lookup(name)
+		}
+		c.recordLock.Unlock()
+
+		if cl != nil {
+			select {
+			case <-cl.done:
+			case <-w.stop:
+				return
+			case <-c.ctx.Done():
+				return
+			}
+			// Don't spin on names that keep failing or have a TTL of 0.
+			wait = c.config.Timeout
+			if cl.err == nil {
+				wait = c.config.MinTTL
+			}
+			if wait < time.Second {
+				wait = time.Second
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-w.refresh:
+		case <-w.stop:
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// notifyWatchers sends the differences between the record set the watchers
+// of name last saw and addrs, recordLock must be held.
+func (c *cache) notifyWatchers(name string, addrs []*net.SRV) {
+	w, ok := c.watches[name]
+	if !ok {
+		return
+	}
+	defer func() {
+		w.last = addrs
+		w.known = true
+	}()
+	if !w.known {
+		return
+	}
+
+	now := time.Now()
+	var events []Event
+	old := make(map[string]*net.SRV, len(w.last))
+	for _, addr := range w.last {
+		old[targetKey(addr)] = addr
+	}
+	current := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		key := targetKey(addr)
+		current[key] = true
+		prev, ok := old[key]
+		switch {
+		case !ok:
+			events = append(events,
+				Event{Name: name, Type: TargetAdded, Target: addr, Time: now})
+		case prev.Priority != addr.Priority || prev.Weight != addr.Weight:
+			events = append(events,
+				Event{Name: name, Type: TargetReweighted, Target: addr, Time: now})
+		}
+	}
+	for _, addr := range w.last {
+		if !current[targetKey(addr)] {
+			events = append(events,
+				Event{Name: name, Type: TargetRemoved, Target: addr, Time: now})
+		}
+	}
+
+	for ch := range w.subs {
+		for _, ev := range events {
+			select {
+			case ch <- ev:
+			default:
+			}
+		}
+	}
+}
+
+func targetKey(addr *net.SRV) string {
+	return net.JoinHostPort(addr.Target, strconv.Itoa(int(addr.Port)))
+}
@@ -16,6 +16,22 @@ const DcosDomain string = ".mydcos.directory"
 // MaxPortLength is the maximum number of digits a (network) port can be.
 const MaxPortLength int = 5
 
+// Queries the server answers on its query socket. A query is the command
+// followed by space separated arguments and terminated by a newline, the
+// response is written to the socket of the client. A lone space is also
+// accepted as a QueryPort for older clients. A QueryWatch keeps the client
+// socket open and streams one JSON event per line.
+const (
+	QueryPort       string = "port"
+	QueryTLSPort    string = "tls-port"
+	QueryEntries    string = "entries"
+	QueryStats      string = "stats"
+	QueryInvalidate string = "invalidate"
+	QueryFlush      string = "flush"
+	QueryPrewarm    string = "prewarm"
+	QueryWatch      string = "watch"
+)
+
 // RmIfExist removes a file (given the path) if it exists.
 func RmIfExist(path string) error {
 	if _, err := os.Stat(path); err == nil {